@@ -26,72 +26,118 @@
 
 package qvrpro
 
-/*
-   #include <stdlib.h>
-
-   int hexToInt(char *hexString){
-       return strtol(hexString, NULL, 0);
-   }
-*/
-import "C"
 import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
 	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
 	"encoding/json"
 	"encoding/xml"
 	"errors"
 	"fmt"
 	"io"
-	"log"
+	"mime"
+	"mime/multipart"
+	"net"
 	"net/http"
 	"net/url"
+	"regexp"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
-	"unsafe"
 )
 
+// convertHexToInt parses a "0x..." error code the way the NAS reports it, as a
+// signed 32-bit value, so codes with the high bit set come out negative.
 func convertHexToInt(hexString string) int {
-	p := C.CString(hexString)
-	defer C.free(unsafe.Pointer(p))
+	n, err := strconv.ParseInt(hexString, 0, 64)
+	if err != nil {
+		return 0
+	}
 
-	n := C.hexToInt(p)
-	return int(n)
+	return int(int32(n))
 }
 
 type ShutDownInfo struct {
-	XMLName   xml.Name `xml:"shutdown_info"`
-	Type      int64    `xml:"type"`
-	TimeStamp int64    `xml:"timestamp"`
-	Duration  int64    `xml:"duration"`
+	XMLName   xml.Name `xml:"shutdown_info" json:"-"`
+	Type      int64    `xml:"type" json:"type"`
+	TimeStamp int64    `xml:"timestamp" json:"timestamp"`
+	Duration  int64    `xml:"duration" json:"duration"`
 }
 
 type QDocRoot struct {
-	XMLName         xml.Name     `xml:"QDocRoot"`
-	DoQuick         string       `xml:"doQuick"`
-	IsBooting       string       `xml:"is_booting"`
-	MediaReady      string       `xml:"mediaReady"`
-	ShutdownInfo    ShutDownInfo `xml:"shutdown_info"`
-	SMBFW           int          `xml:"SMBFW"`
-	AuthPassed      int          `xml:"authPassed"`
-	AuthSid         string       `xml:"authSid"`
-	PwStatus        int          `xml:"pw_status"`
-	IsAdmin         int          `xml:"isAdmin"`
-	User            string       `xml:"username"`
-	GroupName       string       `xml:"groupname"`
-	TS              string       `xml:"ts"`
-	FwNotice        int          `xml:"fwNotice"`
-	SUID            string       `xml:"SUID"`
-	Title           string       `xml:"title"`
-	Content         string       `xml:"content"`
-	PsType          int          `xml:"psType"`
-	StandardMassage string       `xml:"standard_massage"`
-	StandardColor   string       `xml:"standard_color"`
-	StandardSize    string       `xml:"standard_size"`
-	StandardBGStyle string       `xml:"standard_bg_style"`
-	ShowVersion     int          `xml:"showVersion"`
-	ShowLink        string       `xml:"show_link"`
-	CUID            string       `xml:"cuid"`
+	XMLName         xml.Name     `xml:"QDocRoot" json:"-"`
+	DoQuick         string       `xml:"doQuick" json:"doQuick"`
+	IsBooting       string       `xml:"is_booting" json:"is_booting"`
+	MediaReady      string       `xml:"mediaReady" json:"mediaReady"`
+	ShutdownInfo    ShutDownInfo `xml:"shutdown_info" json:"shutdown_info"`
+	SMBFW           int          `xml:"SMBFW" json:"SMBFW"`
+	AuthPassed      int          `xml:"authPassed" json:"authPassed"`
+	AuthSid         string       `xml:"authSid" json:"authSid"`
+	PwStatus        int          `xml:"pw_status" json:"pw_status"`
+	Need2SV         int          `xml:"need_2sv" json:"need_2sv"`
+	IsAdmin         int          `xml:"isAdmin" json:"isAdmin"`
+	User            string       `xml:"username" json:"username"`
+	GroupName       string       `xml:"groupname" json:"groupname"`
+	TS              string       `xml:"ts" json:"ts"`
+	FwNotice        int          `xml:"fwNotice" json:"fwNotice"`
+	SUID            string       `xml:"SUID" json:"SUID"`
+	Title           string       `xml:"title" json:"title"`
+	Content         string       `xml:"content" json:"content"`
+	PsType          int          `xml:"psType" json:"psType"`
+	StandardMassage string       `xml:"standard_massage" json:"standard_massage"`
+	StandardColor   string       `xml:"standard_color" json:"standard_color"`
+	StandardSize    string       `xml:"standard_size" json:"standard_size"`
+	StandardBGStyle string       `xml:"standard_bg_style" json:"standard_bg_style"`
+	ShowVersion     int          `xml:"showVersion" json:"showVersion"`
+	ShowLink        string       `xml:"show_link" json:"show_link"`
+	CUID            string       `xml:"cuid" json:"cuid"`
+	Hostname        string       `xml:"hostname" json:"hostname"`
+	Model           ModelInfo    `xml:"model" json:"model"`
+	Firmware        FirmwareInfo `xml:"firmware" json:"firmware"`
+}
+
+type ModelInfo struct {
+	ModelName         string `xml:"modelName" json:"modelName"`
+	InternalModelName string `xml:"internalModelName" json:"internalModelName"`
+	DisplayModelName  string `xml:"displayModelName" json:"displayModelName"`
+	Platform          string `xml:"platform" json:"platform"`
+}
+
+type FirmwareInfo struct {
+	Version   string `xml:"version" json:"version"`
+	Number    string `xml:"number" json:"number"`
+	Build     string `xml:"build" json:"build"`
+	BuildTime string `xml:"buildTime" json:"buildTime"`
+}
+
+// decodeLoginResponse parses an authLogin.cgi response, which older firmware
+// sends as XML and newer firmware may send as JSON with the same field names.
+// The Content-Type decides, falling back on the first byte of the body when
+// the NAS sends a generic one.
+func decodeLoginResponse(contentType string, body []byte, qdoc *QDocRoot) error {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	trimmed := bytes.TrimSpace(body)
+
+	if strings.HasSuffix(mediaType, "json") || (len(trimmed) > 0 && trimmed[0] == '{') {
+		if err := json.Unmarshal(trimmed, qdoc); err != nil {
+			return fmt.Errorf("qvrpro: malformed JSON login response: %w", err)
+		}
+		return nil
+	}
+
+	if err := xml.Unmarshal(body, qdoc); err != nil {
+		return fmt.Errorf("qvrpro: malformed XML login response: %w", err)
+	}
+	return nil
 }
 
 type QvrApplication string
@@ -99,8 +145,8 @@ type QvrApplication string
 //goland:noinspection GoUnusedConst
 const (
 	QvrPro     QvrApplication = "qvrpro"
-	QvrElite                  = "qvrelite"
-	QvrUnknown                = "unknown"
+	QvrElite   QvrApplication = "qvrelite"
+	QvrUnknown QvrApplication = "unknown"
 )
 
 //goland:noinspection GoUnusedExportedFunction
@@ -114,531 +160,4166 @@ func QvrApplicationParse(app string) QvrApplication {
 	return QvrUnknown
 }
 
+func (app QvrApplication) String() string {
+	return string(app)
+}
+
+// MarshalJSON writes app in its canonical lowercase form, "unknown" for
+// anything QvrApplicationParse does not recognise.
+func (app QvrApplication) MarshalJSON() ([]byte, error) {
+	return json.Marshal(string(QvrApplicationParse(string(app))))
+}
+
+// UnmarshalJSON reads an application name in any case through
+// QvrApplicationParse, so unrecognised names become QvrUnknown.
+func (app *QvrApplication) UnmarshalJSON(data []byte) error {
+	var name string
+	if err := json.Unmarshal(data, &name); err != nil {
+		return err
+	}
+
+	*app = QvrApplicationParse(name)
+	return nil
+}
+
 type Connection struct {
-	url     string
-	sid     string
-	expire  int64
-	timeout int64
-	qvrApp  QvrApplication
+	url       string
+	sid       string
+	expire    int64
+	timeout   int64 // session lifetime in seconds; see WithRequestTimeout
+	qvrApp    QvrApplication
+	user      string
+	password  string
+	client    *http.Client
+	tlsConfig *tls.Config
+	logger    Logger
+	qdoc      *QDocRoot
+
+	requestTimeout time.Duration
+	metrics        MetricsObserver
+	sessions       SessionObserver
+	userAgent      string
+	basicAuth      bool
+
+	// maxIdleConns and idleConnTimeout tune the transport NewConnection
+	// builds; see WithConnectionPool.
+	maxIdleConns    int
+	idleConnTimeout time.Duration
+
+	// ownsClient is set when the connection built its own client, which
+	// Close may then release.
+	ownsClient bool
+
+	apiVersion     string
+	apiPlayVersion string
+	basePath       string
+
+	// playChannels remembers the channel of each open play session for
+	// SessionObserver.OnSessionClose; it is only kept when sessions is set.
+	playChannels map[string]string
+
+	// mu guards sid, expire, user, password, qdoc, qvrApp and playChannels,
+	// which Login and DetectApplication update while other goroutines read
+	// them to sign requests. loginMu serializes the login and logout round trips
+	// themselves.
+	mu      sync.RWMutex
+	loginMu sync.Mutex
 }
 
-var errorCodes map[int]string
+// Logger receives the package's diagnostic output. *log.Logger satisfies it.
+type Logger interface {
+	Printf(format string, v ...any)
+}
+
+// Option configures a Connection built by NewConnection or Create.
+type Option func(connection *Connection)
+
+// MetricsObserver receives measurements of the traffic with the NAS, e.g. to
+// feed a metrics registry. Paths are API endpoints such as "camera/list".
+// ObserveRequest sees the time until the response headers arrived and any
+// transport or HTTP status error (a *StatusError, which wraps the *QvrError
+// the NAS sent); ObserveBytes sees how much PlayGet and LiveStream proxied.
+type MetricsObserver interface {
+	ObserveRequest(path string, duration time.Duration, err error)
+	ObserveBytes(path string, n int64)
+}
 
-var apiVersion = "1.2.0"
-var apiPlayVersion = "v1"
+// WithMetrics reports every request to observer. Connections have none by
+// default.
+//
+//goland:noinspection GoUnusedExportedFunction
+func WithMetrics(observer MetricsObserver) Option {
+	return func(connection *Connection) {
+		connection.metrics = observer
+	}
+}
 
-var singletonConnection *Connection
-var onceConnection sync.Once
+// SessionObserver is told about play sessions as CreateSessionId opens them
+// and CloseSession releases them, e.g. to track which ones are outstanding when
+// the NAS refuses new ones with 0x93010007. OnSessionClose runs whether or not
+// the close succeeded and gets its error; channelId is empty for a session the
+// connection did not open.
+type SessionObserver interface {
+	OnSessionOpen(sessionId string, channelId string)
+	OnSessionClose(sessionId string, channelId string, err error)
+}
 
+// WithSessionObserver reports play sessions to observer. Connections have none
+// by default.
+//
 //goland:noinspection GoUnusedExportedFunction
-func Create(url string, qvrApp QvrApplication, timeout int64) *Connection {
-	onceConnection.Do(func() {
-		singletonConnection = &Connection{
-			url:     url,
-			expire:  0,
-			timeout: timeout,
-			sid:     "",
-			qvrApp:  qvrApp,
-		}
-
-		errorCodes = make(map[int]string)
-
-		errorCodes[convertHexToInt("0x93010002")] = "failed to open play session"
-		errorCodes[convertHexToInt("0x93010006")] = "sid authentication failed"
-		errorCodes[convertHexToInt("0x93010007")] = "failed to open session (session num full)"
-		errorCodes[convertHexToInt("0x93010102")] = "start_time, end_time or time_val not specified"
-		errorCodes[convertHexToInt("0x93010103")] = "channel_id not specified"
-		errorCodes[convertHexToInt("0x93010104")] = "session_id not specified"
-		errorCodes[convertHexToInt("0x93010107")] = "seek_time not specified"
-		errorCodes[convertHexToInt("0x93010108")] = "session_id too long"
-		errorCodes[convertHexToInt("0x93010109")] = "speed_num not specified"
-		errorCodes[convertHexToInt("0x9301010B")] = "enable not specified"
-		errorCodes[convertHexToInt("0x93010201")] = "failed to control stream"
-		errorCodes[convertHexToInt("0x93010202")] = "session not found"
-		errorCodes[convertHexToInt("0x93010203")] = "session is being closed"
-		errorCodes[convertHexToInt("0x93010204")] = "no files found"
-		errorCodes[convertHexToInt("0x93010003")] = "cmd is illegal"
-		errorCodes[convertHexToInt("0x93010004")] = "insufficient memory"
-		errorCodes[convertHexToInt("0x93000000")] = "Illegal Args"
-		errorCodes[convertHexToInt("0x93000001")] = "Rejected Connection (DDOS)"
-		errorCodes[convertHexToInt("0x93000002")] = "Exceeded Max Connection number"
-		errorCodes[convertHexToInt("0x93000003")] = "Stream not ready"
-		errorCodes[convertHexToInt("0x93000004")] = "Failed to start the stream"
-		errorCodes[convertHexToInt("0x93000005")] = "Auth failed"
-	})
+func WithSessionObserver(observer SessionObserver) Option {
+	return func(connection *Connection) {
+		connection.sessions = observer
+		connection.playChannels = map[string]string{}
+	}
+}
 
-	return singletonConnection
+// WithApplication selects the QVR application whose API the connection
+// talks to, QvrPro by default.
+//
+//goland:noinspection GoUnusedExportedFunction
+func WithApplication(qvrApp QvrApplication) Option {
+	return func(connection *Connection) {
+		connection.qvrApp = qvrApp
+	}
 }
 
-func (connection *Connection) PlayPath() string {
-	return fmt.Sprintf("/%s/apis/qplay.cgi", connection.qvrApp)
+// WithTimeout sets how long a session is trusted after Login before the
+// connection logs in again, rounded down to whole seconds. Anything under a
+// second would log in again on every call and is replaced by the default of
+// defaultTimeout seconds.
+//
+//goland:noinspection GoUnusedExportedFunction
+func WithTimeout(timeout time.Duration) Option {
+	return func(connection *Connection) {
+		connection.timeout = int64(timeout / time.Second)
+		if connection.timeout <= 0 {
+			connection.timeout = defaultTimeout
+		}
+	}
 }
 
-func (connection *Connection) StreamsPath() string {
-	return fmt.Sprintf("/%s/streaming/getstream.cgi", connection.qvrApp)
+// WithHTTPClient makes the connection send every request through client,
+// e.g. to set proxies, timeouts or trusted roots. Without it all connections
+// share defaultClient. A client given here takes precedence over the TLS
+// options below.
+//
+//goland:noinspection GoUnusedExportedFunction
+func WithHTTPClient(client *http.Client) Option {
+	return func(connection *Connection) {
+		connection.client = client
+	}
 }
 
-func (connection *Connection) LogsPath() string {
-	return fmt.Sprintf("/%s/logs/logs", connection.qvrApp)
+// WithTransport sends every request through transport, such as a test double
+// that answers with canned responses or a RoundTripper adding tracing. Like
+// WithHTTPClient, it takes precedence over the TLS options.
+//
+//goland:noinspection GoUnusedExportedFunction
+func WithTransport(transport http.RoundTripper) Option {
+	return func(connection *Connection) {
+		connection.client = &http.Client{Transport: transport}
+	}
 }
 
-func (connection *Connection) CameraListPath() string {
-	return fmt.Sprintf("/%s/camera/list", connection.qvrApp)
+// WithConnectionPool keeps up to maxIdle idle connections to the NAS open for
+// idleTimeout, so bursts of requests such as snapshot polling reuse them
+// instead of paying for a new TLS handshake each time. The standard transport
+// keeps only two per host. Zero leaves a setting at the transport's default.
+// Like the TLS options, it only shapes the transport the connection builds
+// itself and is ignored alongside WithHTTPClient or WithTransport.
+//
+//goland:noinspection GoUnusedExportedFunction
+func WithConnectionPool(maxIdle int, idleTimeout time.Duration) Option {
+	return func(connection *Connection) {
+		connection.maxIdleConns = maxIdle
+		connection.idleConnTimeout = idleTimeout
+	}
 }
 
-func (connection *Connection) CameraCapabilityPath() string {
-	return fmt.Sprintf("/%s/camera/capability", connection.qvrApp)
+// WithLogger sends the connection's diagnostic output to logger. Connections
+// are silent by default. Session ids and passwords are masked in logged URLs.
+//
+//goland:noinspection GoUnusedExportedFunction
+func WithLogger(logger Logger) Option {
+	return func(connection *Connection) {
+		connection.logger = logger
+	}
 }
 
-func (connection *Connection) CameraSnapshotPath(channelId string) string {
-	return fmt.Sprintf("/%s/camera/snapshot/%s", connection.qvrApp, channelId)
+// WithRequestTimeout bounds every HTTP exchange with the NAS, including
+// reading the response body, so a hung NAS or stalled camera fails instead of
+// blocking forever. Long-running calls such as LiveStream end when it runs
+// out as well; give those a context instead if they must outlive it. The
+// client passed to WithHTTPClient is copied, not modified.
+//
+//goland:noinspection GoUnusedExportedFunction
+func WithRequestTimeout(timeout time.Duration) Option {
+	return func(connection *Connection) {
+		connection.requestTimeout = timeout
+	}
 }
 
-func (connection *Connection) Logout() {
-	baseUrl, err := url.Parse(connection.url)
+// WithUserAgent sets the User-Agent header of every request, so the NAS access
+// logs show which service called. It defaults to "go-qvrpro/<Version>".
+//
+//goland:noinspection GoUnusedExportedFunction
+func WithUserAgent(userAgent string) Option {
+	return func(connection *Connection) {
+		connection.userAgent = userAgent
+	}
+}
 
-	if err != nil {
-		log.Println("Malformed URL: ", err.Error())
-	} else {
-		baseUrl.Path = "/cgi-bin/authLogin.cgi"
+// WithBasicAuth additionally sends the credentials of the last Login as HTTP
+// Basic auth, for the endpoints that ignore the sid. The password then goes
+// out with every request, so only use it over TLS.
+//
+//goland:noinspection GoUnusedExportedFunction
+func WithBasicAuth(enabled bool) Option {
+	return func(connection *Connection) {
+		connection.basicAuth = enabled
+	}
+}
 
-		params := url.Values{}
-		params.Add("logout", "1")
-		params.Add("sid", connection.sid)
+// WithAPIVersion sets the ver parameter sent to the camera and log APIs, for
+// firmware that expects something other than 1.2.0.
+//
+//goland:noinspection GoUnusedExportedFunction
+func WithAPIVersion(version string) Option {
+	return func(connection *Connection) {
+		connection.apiVersion = version
+	}
+}
 
-		baseUrl.RawQuery = params.Encode()
-		tr := &http.Transport{
-			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+// WithPlayAPIVersion sets the ver parameter sent to qplay.cgi, "v1" by
+// default.
+//
+//goland:noinspection GoUnusedExportedFunction
+func WithPlayAPIVersion(version string) Option {
+	return func(connection *Connection) {
+		connection.apiPlayVersion = version
+	}
+}
+
+// WithBasePath mounts the application's APIs under prefix, so the *Path
+// methods return e.g. "/surveillance/qvrpro/camera/list" for a NAS UI served
+// below a sub path. Unlike a path in the connection's URL it leaves
+// /cgi-bin/authLogin.cgi where it is. The default is no prefix.
+//
+//goland:noinspection GoUnusedExportedFunction
+func WithBasePath(prefix string) Option {
+	return func(connection *Connection) {
+		prefix = strings.Trim(prefix, "/")
+		if len(prefix) > 0 {
+			prefix = "/" + prefix
 		}
-		client := &http.Client{Transport: tr}
+		connection.basePath = prefix
+	}
+}
 
-		log.Printf("[INFO] %s\n", baseUrl.String())
+// WithTLSConfig sets the TLS configuration used to talk to the NAS. By default
+// the NAS certificate is verified against the system roots.
+//
+//goland:noinspection GoUnusedExportedFunction
+func WithTLSConfig(config *tls.Config) Option {
+	return func(connection *Connection) {
+		connection.tlsConfig = config.Clone()
+	}
+}
 
-		response, err := client.Get(baseUrl.String())
-		if err != nil {
-			log.Print(err.Error())
+// WithRootCAs verifies the NAS certificate against pool instead of the system
+// roots, which is the safe way to trust a self-signed certificate.
+//
+//goland:noinspection GoUnusedExportedFunction
+func WithRootCAs(pool *x509.CertPool) Option {
+	return func(connection *Connection) {
+		if connection.tlsConfig == nil {
+			connection.tlsConfig = &tls.Config{}
 		}
+		connection.tlsConfig.RootCAs = pool
+	}
+}
 
-		defer func(Body io.ReadCloser) {
-			_ = Body.Close()
-		}(response.Body)
+// WithInsecureSkipVerify turns certificate verification off. Anyone on the
+// path to the NAS can then read the password sent by Login, so prefer
+// WithRootCAs for self-signed certificates.
+//
+//goland:noinspection GoUnusedExportedFunction
+func WithInsecureSkipVerify(skip bool) Option {
+	return func(connection *Connection) {
+		if connection.tlsConfig == nil {
+			connection.tlsConfig = &tls.Config{}
+		}
+		connection.tlsConfig.InsecureSkipVerify = skip
 	}
+}
 
-	connection.expire = 0
-	connection.sid = ""
+var errorCodes map[int]string
+
+// Version is the version of this package, sent in the default User-Agent.
+const Version = "0.1.0"
+
+const defaultUserAgent = "go-qvrpro/" + Version
+
+const defaultApiVersion = "1.2.0"
+const defaultApiPlayVersion = "v1"
+
+var defaultClient = &http.Client{}
+
+// singletonMu guards singletonConnection, which Create builds once and
+// ResetConnection clears.
+var singletonConnection *Connection
+var singletonMu sync.Mutex
+
+// The error table is filled in once at package load and only read afterwards,
+// so lookups work for any Connection and are safe from multiple goroutines.
+func init() {
+	buildErrorCodes()
+}
+
+func buildErrorCodes() {
+	errorCodes = make(map[int]string)
+
+	errorCodes[convertHexToInt("0x93010002")] = "failed to open play session"
+	errorCodes[convertHexToInt("0x93010006")] = "sid authentication failed"
+	errorCodes[convertHexToInt("0x93010007")] = "failed to open session (session num full)"
+	errorCodes[convertHexToInt("0x93010102")] = "start_time, end_time or time_val not specified"
+	errorCodes[convertHexToInt("0x93010103")] = "channel_id not specified"
+	errorCodes[convertHexToInt("0x93010104")] = "session_id not specified"
+	errorCodes[convertHexToInt("0x93010107")] = "seek_time not specified"
+	errorCodes[convertHexToInt("0x93010108")] = "session_id too long"
+	errorCodes[convertHexToInt("0x93010109")] = "speed_num not specified"
+	errorCodes[convertHexToInt("0x9301010B")] = "enable not specified"
+	errorCodes[convertHexToInt("0x93010201")] = "failed to control stream"
+	errorCodes[convertHexToInt("0x93010202")] = "session not found"
+	errorCodes[convertHexToInt("0x93010203")] = "session is being closed"
+	errorCodes[convertHexToInt("0x93010204")] = "no files found"
+	errorCodes[convertHexToInt("0x93010003")] = "cmd is illegal"
+	errorCodes[convertHexToInt("0x93010004")] = "insufficient memory"
+	errorCodes[convertHexToInt("0x93000000")] = "Illegal Args"
+	errorCodes[convertHexToInt("0x93000001")] = "Rejected Connection (DDOS)"
+	errorCodes[convertHexToInt("0x93000002")] = "Exceeded Max Connection number"
+	errorCodes[convertHexToInt("0x93000003")] = "Stream not ready"
+	errorCodes[convertHexToInt("0x93000004")] = "Failed to start the stream"
+	errorCodes[convertHexToInt("0x93000005")] = "Auth failed"
+	errorCodes[convertHexToInt("0xB1000000")] = "API version not supported"
+	errorCodes[convertHexToInt("0xB1000001")] = "Authorization failed"
+	errorCodes[convertHexToInt("0xB1000002")] = "Insufficient permissions"
+	errorCodes[convertHexToInt("0xB1000003")] = "Invalid parameters or missing parameters"
+	errorCodes[convertHexToInt("0xB1000004")] = "Invalid request"
+	errorCodes[convertHexToInt("0xB1000005")] = "Failed to allocate memory"
+	errorCodes[convertHexToInt("0xB1000006")] = "Failed to get a snapshot"
+	errorCodes[convertHexToInt("0xB100001E")] = "Failed to get the camera information"
+	errorCodes[convertHexToInt("0xB1000021")] = "Failed to get the camera license information"
+	errorCodes[convertHexToInt("0xB1000022")] = "Failed to get the license domain information"
+	errorCodes[convertHexToInt("0xB1000023")] = "Channel license expired"
+	errorCodes[convertHexToInt("0x96020001")] = "Invalid parameters or missing parameters"
+	errorCodes[convertHexToInt("0x96020002")] = "Channel locked"
+	errorCodes[convertHexToInt("0x96020003")] = "Operation failed"
+	errorCodes[convertHexToInt("0x96020004")] = "Authorization failed"
+}
+
+// QvrError is returned whenever the NAS answers with a non-zero result code.
+// Code holds the code as it is documented, e.g. 0x93010202 for "session not
+// found", rather than the negative value found in the response body. It is
+// unsigned so the documented value also fits on 32-bit platforms.
+type QvrError struct {
+	Code    uint32
+	Message string
 }
 
-func (connection *Connection) Login(user string, password string) bool {
+func (qvrError *QvrError) Error() string {
+	return "qvrpro: " + qvrError.Message
+}
 
-	if len(connection.sid) > 0 && connection.expire > time.Now().Unix() {
+func (qvrError *QvrError) authFailure() bool {
+	switch qvrError.Code {
+	case 0x93010006, 0x93000005, 0xB1000001, 0x96020004:
 		return true
 	}
+	return false
+}
 
-	baseUrl, err := url.Parse(connection.url)
+func newQvrError(code int, response string) *QvrError {
+	message, exists := errorCodes[code]
+	if !exists {
+		message = fmt.Sprintf("unknown error code 0x%08X (response %q)", uint32(code), response)
+	}
+
+	return &QvrError{Code: uint32(code), Message: message}
+}
+
+// splitPlayResponse splits a qplay.cgi response into its lines, refusing bodies
+// that are too short to hold the expected fields (an HTML error page or an
+// empty body while the NAS reboots, for instance).
+func splitPlayResponse(body []byte, minLines int) ([]string, error) {
+	v := strings.Split(string(body), "\n")
+	if len(v) < minLines {
+		const maxBody = 128
+		if len(body) > maxBody {
+			body = body[:maxBody]
+		}
+		return nil, fmt.Errorf("qvrpro: malformed play response, expected >=%d lines got %d: %q", minLines, len(v), body)
+	}
+
+	return v, nil
+}
+
+// newApiError converts the error_code of a failed camera API response, which
+// is sent as an unsigned number, into a QvrError.
+func newApiError(errorCode int64, body []byte) *QvrError {
+	return newQvrError(int(int32(errorCode)), string(body))
+}
+
+// playResultCode parses the result line of a qplay.cgi response, which is 0 on
+// success and a negative error code otherwise.
+func playResultCode(line string) (int, error) {
+	code, err := strconv.Atoi(strings.TrimSpace(line))
 	if err != nil {
-		log.Println("Malformed URL: ", err.Error())
-		connection.Logout()
-		return false
+		return 0, fmt.Errorf("qvrpro: malformed play result %q", line)
 	}
 
-	baseUrl.Path = "/cgi-bin/authLogin.cgi"
+	return code, nil
+}
 
-	params := url.Values{}
-	params.Add("serviceKey", "1")
-	params.Add("pwd", password)
-	params.Add("user", user)
+// readPlayResult consumes the result line that precedes the data of a
+// qplay.cgi get or getstream.cgi response, skipping the blank line the NAS
+// may send first, and converts a failure into a QvrError.
+func readPlayResult(reader *bufio.Reader) error {
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil && (err != io.EOF || line == "") {
+			return fmt.Errorf("qvrpro: malformed play response: %w", err)
+		}
 
-	baseUrl.RawQuery = params.Encode()
-	tr := &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+
+		code, err := playResultCode(line)
+		if err != nil {
+			return err
+		}
+
+		if code != 0 {
+			return newQvrError(code, strings.TrimSpace(line))
+		}
+
+		return nil
 	}
-	client := &http.Client{Transport: tr}
+}
 
-	log.Printf("[INFO] %s\n", baseUrl.String())
+// defaultTimeout is the session lifetime in seconds of connections built
+// without WithTimeout.
+const defaultTimeout = 300
 
-	response, err := client.Get(baseUrl.String())
-	if err != nil {
-		log.Println("Get Failed: ", err.Error())
-		connection.Logout()
-		return false
+// NewConnection returns a connection to the NAS at url. Without options it
+// talks to QVR Pro with a five minute session lifetime and the shared
+// certificate-verifying client. A path in url, such as the device prefix of a
+// myQNAPcloud relay, is put in front of every API path. The relay's own sign-in
+// is not part of the QVR Pro API; url must already reach the NAS's login.
+//
+//goland:noinspection GoUnusedExportedFunction
+func NewConnection(url string, opts ...Option) *Connection {
+	connection := &Connection{
+		url:            url,
+		expire:         0,
+		timeout:        defaultTimeout,
+		sid:            "",
+		qvrApp:         QvrPro,
+		apiVersion:     defaultApiVersion,
+		apiPlayVersion: defaultApiPlayVersion,
+		userAgent:      defaultUserAgent,
 	}
 
-	defer func(Body io.ReadCloser) {
-		_ = Body.Close()
-	}(response.Body)
+	for _, opt := range opts {
+		opt(connection)
+	}
 
-	body, err := io.ReadAll(response.Body)
+	if connection.client == nil {
+		connection.client = defaultClient
 
-	if nil != err {
-		log.Print(err)
-		log.Println(string(body))
-		connection.Logout()
-		return false
+		if connection.tlsConfig != nil || connection.maxIdleConns > 0 || connection.idleConnTimeout > 0 {
+			tr := http.DefaultTransport.(*http.Transport).Clone()
+			if connection.tlsConfig != nil {
+				tr.TLSClientConfig = connection.tlsConfig
+			}
+			if connection.maxIdleConns > 0 {
+				tr.MaxIdleConnsPerHost = connection.maxIdleConns
+			}
+			if connection.idleConnTimeout > 0 {
+				tr.IdleConnTimeout = connection.idleConnTimeout
+			}
+			connection.client = &http.Client{Transport: tr}
+			connection.ownsClient = true
+		}
 	}
 
-	var qdoc QDocRoot
-	log.Println(string(body))
-	err = xml.Unmarshal(body, &qdoc)
+	if connection.requestTimeout > 0 {
+		client := *connection.client
+		client.Timeout = connection.requestTimeout
+		connection.client = &client
+	}
 
-	if nil != err {
-		log.Print(err)
-		log.Println(string(body))
-		connection.Logout()
-		return false
+	return connection
+}
+
+// Create returns the process-wide connection, building it on the first call;
+// later calls ignore their arguments. timeout is the session lifetime in
+// seconds; values <= 0 fall back to defaultTimeout.
+//
+// Deprecated: use NewConnection with WithApplication and WithTimeout.
+//
+//goland:noinspection GoUnusedExportedFunction
+func Create(url string, qvrApp QvrApplication, timeout int64, opts ...Option) *Connection {
+	singletonMu.Lock()
+	defer singletonMu.Unlock()
+
+	if singletonConnection == nil {
+		opts = append([]Option{WithApplication(qvrApp), WithTimeout(time.Duration(timeout) * time.Second)}, opts...)
+		singletonConnection = NewConnection(url, opts...)
 	}
 
-	if qdoc.AuthPassed != 0 {
-		connection.sid = qdoc.AuthSid
-		connection.expire = time.Now().Unix() + connection.timeout
-	} else {
-		log.Print("Auth Failed")
+	return singletonConnection
+}
+
+// ResetConnection forgets the process-wide connection so the next Create builds
+// a new one from its arguments, e.g. to point a test at a fake server. The old
+// connection keeps working for whoever still holds it; it is not logged out.
+//
+// Deprecated: connections from NewConnection need no reset.
+//
+//goland:noinspection GoUnusedExportedFunction
+func ResetConnection() {
+	singletonMu.Lock()
+	defer singletonMu.Unlock()
+
+	singletonConnection = nil
+}
+
+// BaseURL builds the URL of a NAS from its host and port, using https when
+// useTLS is set. IPv6 literals may be given with or without brackets.
+func BaseURL(host string, port int, useTLS bool) (string, error) {
+	host = strings.TrimSuffix(strings.TrimPrefix(strings.TrimSpace(host), "["), "]")
+	if len(host) == 0 || strings.ContainsAny(host, "/?#@ ") {
+		return "", fmt.Errorf("qvrpro: invalid host %q", host)
+	}
+
+	if port <= 0 || port > 65535 {
+		return "", fmt.Errorf("qvrpro: invalid port %d", port)
 	}
 
-	return qdoc.AuthPassed != 0
+	scheme := "http"
+	if useTLS {
+		scheme = "https"
+	}
+
+	return scheme + "://" + net.JoinHostPort(host, strconv.Itoa(port)), nil
 }
 
-func (connection *Connection) CameraList() ([]byte, error) {
-	baseUrl, err := url.Parse(connection.url)
+// CreateFromHost is Create with the URL built by BaseURL.
+//
+//goland:noinspection GoUnusedExportedFunction
+func CreateFromHost(host string, port int, useTLS bool, qvrApp QvrApplication, timeout int64, opts ...Option) (*Connection, error) {
+	baseUrl, err := BaseURL(host, port, useTLS)
 	if err != nil {
 		return nil, err
 	}
 
-	baseUrl.Path = connection.CameraListPath()
+	return Create(baseUrl, qvrApp, timeout, opts...), nil
+}
 
-	params := url.Values{}
-	params.Add("sid", connection.sid)
-	params.Add("ver", apiVersion)
+var ErrEmptyChannelID = errors.New("qvrpro: empty channel id")
+var ErrEmptyStreamID = errors.New("qvrpro: empty stream id")
 
-	baseUrl.RawQuery = params.Encode()
-	tr := &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+// validateChannelID rejects channel ids that cannot be a channel GUID before
+// they end up in a URL path or query, where the NAS answers with an opaque
+// error code.
+func validateChannelID(channelId string) error {
+	if len(channelId) == 0 {
+		return ErrEmptyChannelID
 	}
-	client := &http.Client{Transport: tr}
 
-	log.Printf("[INFO] %s\n", baseUrl.String())
+	if strings.ContainsAny(channelId, "/?#&% \t\r\n") {
+		return fmt.Errorf("qvrpro: malformed channel id %q", channelId)
+	}
 
-	response, err := client.Get(baseUrl.String())
-	if err != nil {
-		return nil, err
+	return nil
+}
+
+// validateStreamID accepts the numeric stream ids the NAS uses.
+func validateStreamID(streamId string) error {
+	if len(streamId) == 0 {
+		return ErrEmptyStreamID
 	}
 
-	defer func(Body io.ReadCloser) {
-		_ = Body.Close()
-	}(response.Body)
+	if _, err := strconv.ParseUint(streamId, 10, 8); err != nil {
+		return fmt.Errorf("qvrpro: malformed stream id %q", streamId)
+	}
 
-	body, err := io.ReadAll(response.Body)
+	return nil
+}
+
+// Application returns the QVR application whose API paths the connection
+// uses.
+func (connection *Connection) Application() QvrApplication {
+	connection.mu.RLock()
+	defer connection.mu.RUnlock()
+	return connection.qvrApp
+}
+
+func (connection *Connection) DetectApplication() (QvrApplication, error) {
+	return connection.DetectApplicationContext(context.Background())
+}
+
+// DetectApplicationContext finds out whether the NAS runs QVR Pro or QVR
+// Elite by asking each for its camera list, and switches the connection to
+// the one that answers with a successful one. It needs a logged in session;
+// if neither answers the application is left unchanged and the error of the
+// last probe returned.
+func (connection *Connection) DetectApplicationContext(ctx context.Context) (QvrApplication, error) {
+	connection.ensureAuth(ctx)
+
+	var err error
+	for _, app := range []QvrApplication{QvrPro, QvrElite} {
+		var baseUrl *url.URL
+		baseUrl, err = connection.resolve(fmt.Sprintf("%s/%s/camera/list", connection.basePath, app))
+		if err != nil {
+			return QvrUnknown, err
+		}
+
+		params := url.Values{}
+		params.Add("sid", connection.Sid())
+		params.Add("ver", connection.apiVersion)
+		baseUrl.RawQuery = params.Encode()
+
+		var response *http.Response
+		response, err = connection.get(ctx, baseUrl)
+		if err != nil {
+			continue
+		}
+
+		var body []byte
+		body, err = io.ReadAll(response.Body)
+		_ = response.Body.Close()
+		if err != nil {
+			continue
+		}
 
+		// a redirect to the login page answers too, so only a camera list
+		// the application accepted counts
+		var cameraList CameraListResponse
+		if err = json.Unmarshal(body, &cameraList); err != nil {
+			err = fmt.Errorf("qvrpro: %s sent no camera list: %w", app, err)
+			continue
+		}
+		if !cameraList.Success {
+			err = newApiError(cameraList.ErrorCode, body)
+			continue
+		}
+
+		connection.mu.Lock()
+		connection.qvrApp = app
+		connection.mu.Unlock()
+
+		return app, nil
+	}
+
+	return QvrUnknown, err
+}
+
+var ErrInvalidURL = errors.New("qvrpro: invalid NAS URL")
+
+// resolve returns the URL of path on the NAS. A path in the connection's URL,
+// e.g. the device prefix of a myQNAPcloud relay, is kept in front of it. The
+// URL must be absolute http or https with a host; IPv6 hosts need brackets,
+// which BaseURL adds.
+func (connection *Connection) resolve(path string) (*url.URL, error) {
+	baseUrl, err := url.Parse(connection.url)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("%w: %v", ErrInvalidURL, err)
+	}
+
+	// older parsers accept an unbracketed IPv6 host, leaving it unclear where
+	// the address ends and the port begins
+	if strings.Count(baseUrl.Host, ":") > 1 && !strings.HasPrefix(baseUrl.Host, "[") {
+		return nil, fmt.Errorf("%w %q: IPv6 hosts must be bracketed", ErrInvalidURL, connection.url)
+	}
+
+	if baseUrl.Scheme != "http" && baseUrl.Scheme != "https" {
+		return nil, fmt.Errorf("%w %q: scheme must be http or https", ErrInvalidURL, connection.url)
+	}
+	if len(baseUrl.Hostname()) == 0 {
+		return nil, fmt.Errorf("%w %q: no host", ErrInvalidURL, connection.url)
 	}
-	return body, nil
+
+	baseUrl.Path = strings.TrimSuffix(baseUrl.Path, "/") + path
+	baseUrl.RawPath = ""
+
+	return baseUrl, nil
 }
 
-func (connection *Connection) CameraCapability() ([]byte, error) {
+// pathPrefix is the path of the connection's URL that resolve puts in front of
+// every request, without the trailing slash.
+func (connection *Connection) pathPrefix() string {
 	baseUrl, err := url.Parse(connection.url)
 	if err != nil {
-		return nil, err
+		return ""
 	}
+	return strings.TrimSuffix(baseUrl.Path, "/")
+}
 
-	baseUrl.Path = connection.CameraCapabilityPath()
+// appPrefix is the path the application's APIs live under, by default
+// "/qvrpro" or "/qvrelite".
+func (connection *Connection) appPrefix() string {
+	return connection.basePath + "/" + string(connection.Application())
+}
 
-	params := url.Values{}
-	params.Add("sid", connection.sid)
-	params.Add("ver", apiVersion)
-	params.Add("act", "get_camera_capability")
+func (connection *Connection) PlayPath() string {
+	return fmt.Sprintf("%s/apis/qplay.cgi", connection.appPrefix())
+}
+
+func (connection *Connection) StreamsPath() string {
+	return fmt.Sprintf("%s/streaming/getstream.cgi", connection.appPrefix())
+}
+
+func (connection *Connection) LogsPath() string {
+	return fmt.Sprintf("%s/logs/logs", connection.appPrefix())
+}
+
+func (connection *Connection) CameraListPath() string {
+	return fmt.Sprintf("%s/camera/list", connection.appPrefix())
+}
+
+func (connection *Connection) CameraCapabilityPath() string {
+	return fmt.Sprintf("%s/camera/capability", connection.appPrefix())
+}
+
+func (connection *Connection) CameraSnapshotPath(channelId string) string {
+	return fmt.Sprintf("%s/camera/snapshot/%s", connection.appPrefix(), channelId)
+}
+
+func (connection *Connection) ManualRecordingPath(channelId string, action string) string {
+	return fmt.Sprintf("%s/camera/mrec/%s/%s", connection.appPrefix(), channelId, action)
+}
+
+func (connection *Connection) RecordingFilePath(channelId string, stream int) string {
+	return fmt.Sprintf("%s/camera/recordingfile/%s/%d", connection.appPrefix(), channelId, stream)
+}
+
+func (connection *Connection) PTZActionPath(channelId string, actionId string) string {
+	return fmt.Sprintf("%s/ptz/v1/channel_list/%s/ptz/action_list/%s/invoke", connection.appPrefix(), channelId, actionId)
+}
+
+// StatusError is returned when the NAS answers with an HTTP error status, for
+// instance after the session expired or for an unknown channel. Err is the
+// *QvrError the NAS put in the body of the error response, if any, so
+// errors.As finds it through the StatusError.
+type StatusError struct {
+	StatusCode int
+	Path       string
+	Err        error
+}
+
+func (statusError *StatusError) Error() string {
+	if statusError.Err != nil {
+		return fmt.Sprintf("qvrpro: unexpected status %d for %s: %s", statusError.StatusCode, statusError.Path, statusError.Err)
+	}
+	return fmt.Sprintf("qvrpro: unexpected status %d for %s", statusError.StatusCode, statusError.Path)
+}
+
+func (statusError *StatusError) Unwrap() error {
+	return statusError.Err
+}
+
+// ResponseMeta is what the NAS answered besides the body, for callers chasing
+// firmware quirks. URL is the final one after redirects, with credentials
+// masked. Error statuses never get this far; they are returned as a
+// *StatusError.
+type ResponseMeta struct {
+	StatusCode  int
+	ContentType string
+	Header      http.Header
+	URL         string
+}
+
+func newResponseMeta(response *http.Response) *ResponseMeta {
+	meta := &ResponseMeta{
+		StatusCode:  response.StatusCode,
+		ContentType: response.Header.Get("Content-Type"),
+		Header:      response.Header,
+	}
+	if response.Request != nil && response.Request.URL != nil {
+		meta.URL = redactURL(response.Request.URL)
+	}
+	return meta
+}
+
+// fetch sends request and reads the whole body of the answer.
+func (connection *Connection) fetch(request *http.Request) (*ResponseMeta, []byte, error) {
+	response, err := connection.doRequest(request)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	defer func(Body io.ReadCloser) {
+		_ = Body.Close()
+	}(response.Body)
+
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return newResponseMeta(response), body, nil
+}
+
+// maxErrorBody caps how much of an error response is read looking for an
+// API error code.
+const maxErrorBody = 4096
+
+// apiErrorBody extracts the error code of an API_SDK_Error_default body, the
+// JSON the camera APIs send with 403 responses.
+func apiErrorBody(body []byte) error {
+	var apiError struct {
+		Success   bool  `json:"success"`
+		ErrorCode int64 `json:"error_code"`
+	}
+	if json.Unmarshal(body, &apiError) != nil || apiError.Success || apiError.ErrorCode == 0 {
+		return nil
+	}
+	return newApiError(apiError.ErrorCode, body)
+}
+
+// endpoint names the API called by baseUrl, e.g. "camera/list".
+func (connection *Connection) endpoint(baseUrl *url.URL) string {
+	path := strings.TrimPrefix(baseUrl.Path, connection.pathPrefix())
+	path = strings.TrimPrefix(strings.TrimPrefix(path, connection.basePath), "/")
+	return strings.TrimPrefix(path, string(connection.Application())+"/")
+}
+
+func (connection *Connection) observeBytes(path string, n int64) {
+	if connection.metrics != nil {
+		connection.metrics.ObserveBytes(strings.TrimPrefix(path, connection.appPrefix()+"/"), n)
+	}
+}
+
+func (connection *Connection) logf(format string, v ...any) {
+	if connection.logger != nil {
+		connection.logger.Printf(format, v...)
+	}
+}
+
+var sensitiveParams = []string{"pwd", "sid", "security_code"}
+
+// redactURL renders baseUrl with the values of sensitiveParams masked, so it
+// can be logged without leaking credentials.
+func redactURL(baseUrl *url.URL) string {
+	redacted := *baseUrl
+	params := baseUrl.Query()
+
+	var query []string
+	for _, key := range sensitiveParams {
+		if params.Has(key) {
+			params.Del(key)
+			query = append(query, key+"=***")
+		}
+	}
+	if len(params) > 0 {
+		query = append([]string{params.Encode()}, query...)
+	}
+
+	redacted.RawQuery = strings.Join(query, "&")
+	return redacted.String()
+}
+
+var authSidPattern = regexp.MustCompile(`(?s)<authSid>.*?</authSid>`)
+var authSidJSONPattern = regexp.MustCompile(`("authSid"\s*:\s*)"(?:[^"\\]|\\.)*"`)
+
+// redactBody masks the session id in an XML or JSON authLogin.cgi response
+// before it is logged.
+func redactBody(body []byte) string {
+	redacted := authSidPattern.ReplaceAllString(string(body), "<authSid>***</authSid>")
+	return authSidJSONPattern.ReplaceAllString(redacted, `$1"***"`)
+}
+
+func (connection *Connection) get(ctx context.Context, baseUrl *url.URL) (*http.Response, error) {
+	return connection.do(ctx, http.MethodGet, baseUrl)
+}
+
+// do sends the request and returns the response only when err is nil, so
+// callers check err before deferring response.Body.Close(). Error responses
+// are closed here and reported as *StatusError.
+func (connection *Connection) do(ctx context.Context, method string, baseUrl *url.URL) (*http.Response, error) {
+	request, err := http.NewRequestWithContext(ctx, method, baseUrl.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return connection.doRequest(request)
+}
+
+// doRequest sends a request built by do or one of the *Request builders.
+func (connection *Connection) doRequest(request *http.Request) (*http.Response, error) {
+	baseUrl := request.URL
+
+	if len(request.Header.Get("User-Agent")) == 0 && len(connection.userAgent) > 0 {
+		request.Header.Set("User-Agent", connection.userAgent)
+	}
+
+	if connection.basicAuth && request.URL.Path != connection.pathPrefix()+"/cgi-bin/authLogin.cgi" {
+		if user, password := connection.credentials(); len(user) > 0 {
+			request.SetBasicAuth(user, password)
+		}
+	}
+
+	client := connection.client
+	if client == nil {
+		client = defaultClient
+	}
+
+	connection.logf("[INFO] %s\n", redactURL(baseUrl))
+
+	started := time.Now()
+	response, err := connection.send(client, request, baseUrl)
+	if connection.metrics != nil {
+		connection.metrics.ObserveRequest(connection.endpoint(baseUrl), time.Since(started), err)
+	}
+
+	return response, err
+}
+
+func (connection *Connection) send(client *http.Client, request *http.Request, baseUrl *url.URL) (*http.Response, error) {
+	response, err := client.Do(request)
+
+	// *url.Error quotes the full request URL, credentials included
+	var urlError *url.Error
+	if errors.As(err, &urlError) {
+		urlError.URL = redactURL(baseUrl)
+	}
+	if err != nil {
+		if response != nil && response.Body != nil {
+			_ = response.Body.Close()
+		}
+		return nil, err
+	}
+
+	if err := decodeContentEncoding(response); err != nil {
+		_ = response.Body.Close()
+		return nil, err
+	}
+
+	if response.StatusCode >= http.StatusBadRequest {
+		body, _ := io.ReadAll(io.LimitReader(response.Body, maxErrorBody))
+		_ = response.Body.Close()
+		return nil, &StatusError{StatusCode: response.StatusCode, Path: connection.endpoint(baseUrl), Err: apiErrorBody(body)}
+	}
+
+	return response, nil
+}
+
+// decodeContentEncoding replaces a gzip or deflate encoded body with its
+// decompressed content. The transport only does so for encodings it asked
+// for itself, while proxies in front of the NAS sometimes compress anyway or
+// the caller's transport has compression disabled. As the transport does,
+// Content-Encoding and Content-Length are dropped since they no longer apply.
+func decodeContentEncoding(response *http.Response) error {
+	var decoded io.ReadCloser
+	switch strings.ToLower(strings.TrimSpace(response.Header.Get("Content-Encoding"))) {
+	case "gzip", "x-gzip":
+		reader, err := gzip.NewReader(response.Body)
+		if err != nil {
+			return fmt.Errorf("qvrpro: gzip encoded response: %w", err)
+		}
+		decoded = reader
+	case "deflate":
+		// RFC 9110 deflate is zlib framed, but some servers send raw deflate
+		buffered := bufio.NewReader(response.Body)
+		if header, err := buffered.Peek(2); err == nil && (uint16(header[0])<<8|uint16(header[1]))%31 == 0 && header[0]&0x0f == 8 {
+			reader, err := zlib.NewReader(buffered)
+			if err != nil {
+				return fmt.Errorf("qvrpro: deflate encoded response: %w", err)
+			}
+			decoded = reader
+		} else {
+			decoded = flate.NewReader(buffered)
+		}
+	default:
+		return nil
+	}
+
+	response.Body = decodedBody{ReadCloser: decoded, raw: response.Body}
+	response.Header.Del("Content-Encoding")
+	response.Header.Del("Content-Length")
+	response.ContentLength = -1
+	response.Uncompressed = true
+
+	return nil
+}
+
+// decodedBody closes both the decompressor and the body it reads from.
+type decodedBody struct {
+	io.ReadCloser
+	raw io.ReadCloser
+}
+
+func (body decodedBody) Close() error {
+	_ = body.ReadCloser.Close()
+	return body.raw.Close()
+}
+
+func (connection *Connection) Logout() error {
+	return connection.LogoutContext(context.Background())
+}
+
+// LogoutContext ends the session and forgets the credentials remembered by
+// Login, so later calls no longer log in again on their own. The local state
+// is cleared even when the NAS could not be reached; the returned error then
+// means the sid may still be valid on the NAS until it times out.
+func (connection *Connection) LogoutContext(ctx context.Context) error {
+	connection.loginMu.Lock()
+	defer connection.loginMu.Unlock()
+
+	err := connection.endSession(ctx)
+
+	connection.mu.Lock()
+	connection.user = ""
+	connection.password = ""
+	connection.qdoc = nil
+	connection.mu.Unlock()
+
+	return err
+}
+
+// Close logs out if a session is open, forgets the credentials and releases
+// idle keep-alive connections of a client the connection created itself.
+// Clients shared with other connections or passed in with WithHTTPClient are
+// left alone. Close may be called more than once and after Logout.
+func (connection *Connection) Close() error {
+	err := connection.Logout()
+
+	if connection.ownsClient {
+		connection.client.CloseIdleConnections()
+	}
+
+	return err
+}
+
+// Sid returns the current session id, or "" when not logged in.
+func (connection *Connection) Sid() string {
+	connection.mu.RLock()
+	defer connection.mu.RUnlock()
+	return connection.sid
+}
+
+// IsAuthenticated reports whether the connection holds a session that has not
+// yet expired. It never contacts the NAS, so it does not extend the session.
+func (connection *Connection) IsAuthenticated() bool {
+	connection.mu.RLock()
+	defer connection.mu.RUnlock()
+	return len(connection.sid) > 0 && connection.expire > time.Now().Unix()
+}
+
+// ExpiresAt returns when the current session is due to expire, or the zero
+// time when not logged in.
+func (connection *Connection) ExpiresAt() time.Time {
+	connection.mu.RLock()
+	defer connection.mu.RUnlock()
+	if len(connection.sid) == 0 {
+		return time.Time{}
+	}
+	return time.Unix(connection.expire, 0)
+}
+
+// LoginInfo returns a copy of the full authLogin.cgi response of the last
+// successful login, or nil after Logout or before the first login.
+func (connection *Connection) LoginInfo() *QDocRoot {
+	connection.mu.RLock()
+	defer connection.mu.RUnlock()
+	if connection.qdoc == nil {
+		return nil
+	}
+	qdoc := *connection.qdoc
+	return &qdoc
+}
+
+// IsAdmin reports whether the logged in user is an administrator, from the
+// isAdmin flag of the last successful login. It is false when not logged in.
+func (connection *Connection) IsAdmin() bool {
+	connection.mu.RLock()
+	defer connection.mu.RUnlock()
+	return connection.qdoc != nil && connection.qdoc.IsAdmin != 0
+}
+
+// PasswordStatus returns pw_status from the last successful login, 0 when not
+// logged in. The NAS sets it to a non-zero value to ask for the password to be
+// changed, e.g. once it has expired.
+func (connection *Connection) PasswordStatus() int {
+	connection.mu.RLock()
+	defer connection.mu.RUnlock()
+	if connection.qdoc == nil {
+		return 0
+	}
+	return connection.qdoc.PwStatus
+}
+
+func (connection *Connection) credentials() (string, string) {
+	connection.mu.RLock()
+	defer connection.mu.RUnlock()
+	return connection.user, connection.password
+}
+
+func (connection *Connection) clearSession() {
+	connection.mu.Lock()
+	connection.sid = ""
+	connection.expire = 0
+	connection.mu.Unlock()
+}
+
+// endSession logs the current session out on the NAS, if there is one. The
+// caller holds loginMu.
+func (connection *Connection) endSession(ctx context.Context) error {
+	sid := connection.Sid()
+	connection.clearSession()
+
+	if len(sid) == 0 {
+		return nil
+	}
+
+	baseUrl, err := connection.resolve("/cgi-bin/authLogin.cgi")
+	if err != nil {
+		connection.logf("[ERROR] Malformed URL: %s\n", err.Error())
+		return err
+	}
+
+	params := url.Values{}
+	params.Add("logout", "1")
+	params.Add("sid", sid)
+
+	baseUrl.RawQuery = params.Encode()
+	response, err := connection.get(ctx, baseUrl)
+	if err != nil {
+		connection.logf("[ERROR] %s\n", err.Error())
+		return err
+	}
+
+	return response.Body.Close()
+}
+
+func (connection *Connection) Login(user string, password string) (bool, error) {
+	return connection.LoginContext(context.Background(), user, password)
+}
+
+// LoginContext reports whether the login succeeded. A rejected password
+// yields ErrAuthFailed, which is not worth retrying and stops the automatic
+// renewal of the session until Login is called again; any other error
+// (network, malformed response, ErrBooting) may clear up on its own.
+func (connection *Connection) LoginContext(ctx context.Context, user string, password string) (bool, error) {
+	_, err := connection.LoginDetailedContext(ctx, user, password)
+	return err == nil, err
+}
+
+var ErrAuthFailed = errors.New("qvrpro: authentication failed")
+var ErrBooting = errors.New("qvrpro: NAS is still booting")
+var ErrOTPRequired = errors.New("qvrpro: 2-step verification code required")
+
+func (qdoc *QDocRoot) Booting() bool {
+	booting := strings.TrimSpace(qdoc.IsBooting)
+	return len(booting) > 0 && booting != "0"
+}
+
+// MediaIsReady reports whether the NAS has its media ready for playback.
+// Firmware that does not send mediaReady is assumed to be ready.
+func (qdoc *QDocRoot) MediaIsReady() bool {
+	return strings.TrimSpace(qdoc.MediaReady) != "0"
+}
+
+func (connection *Connection) LoginDetailed(user string, password string) (*QDocRoot, error) {
+	return connection.LoginDetailedContext(context.Background(), user, password)
+}
+
+// LoginDetailedContext logs in and returns the full authLogin.cgi response.
+// The error is ErrBooting while the NAS starts up, ErrOTPRequired when the
+// account needs a 2-step verification code (see LoginOTP), ErrAuthFailed
+// when the credentials are rejected, and the underlying error for network or
+// parsing problems. While the session is still valid it returns the response of the
+// login that opened it without contacting the NAS; other credentials log the
+// session out and log in afresh.
+func (connection *Connection) LoginDetailedContext(ctx context.Context, user string, password string) (*QDocRoot, error) {
+	return connection.login(ctx, user, password, "")
+}
+
+func (connection *Connection) LoginOTP(user string, password string, otp string) (bool, error) {
+	return connection.LoginOTPContext(context.Background(), user, password, otp)
+}
+
+// LoginOTPContext logs in an account with 2-step verification enabled, passing
+// the current verification code as authLogin.cgi's security_code. Login
+// returns ErrOTPRequired for such accounts so the caller knows to prompt for
+// the code. The code is used once: renewing an expired session later sends
+// only the user and password, so long-running clients should expect
+// ErrOTPRequired again.
+func (connection *Connection) LoginOTPContext(ctx context.Context, user string, password string, otp string) (bool, error) {
+	_, err := connection.login(ctx, user, password, otp)
+	return err == nil, err
+}
+
+func (connection *Connection) login(ctx context.Context, user string, password string, otp string) (*QDocRoot, error) {
+	connection.loginMu.Lock()
+	defer connection.loginMu.Unlock()
+
+	return connection.loginLocked(ctx, user, password, otp)
+}
+
+// loginLocked does the work of login. The caller holds loginMu.
+func (connection *Connection) loginLocked(ctx context.Context, user string, password string, otp string) (*QDocRoot, error) {
+	if connection.IsAuthenticated() {
+		currentUser, currentPassword := connection.credentials()
+		if currentUser == user && currentPassword == password {
+			// a copy, like LoginInfo, so callers cannot alter the stored response
+			return connection.LoginInfo(), nil
+		}
+
+		// another identity must not reuse the session, nor fall back to the
+		// previous one's credentials if its own login fails
+		connection.logf("[INFO] Credentials changed, logging out %s\n", currentUser)
+		_ = connection.endSession(ctx)
+
+		connection.mu.Lock()
+		connection.user = ""
+		connection.password = ""
+		connection.qdoc = nil
+		connection.mu.Unlock()
+	}
+
+	baseUrl, err := connection.resolve("/cgi-bin/authLogin.cgi")
+	if err != nil {
+		connection.logf("[ERROR] Malformed URL: %s\n", err.Error())
+		_ = connection.endSession(ctx)
+		return nil, err
+	}
+
+	params := url.Values{}
+	params.Add("serviceKey", "1")
+	params.Add("pwd", password)
+	params.Add("user", user)
+	if len(otp) > 0 {
+		params.Add("security_code", otp)
+	}
+
+	baseUrl.RawQuery = params.Encode()
+	response, err := connection.get(ctx, baseUrl)
+	if err != nil {
+		connection.logf("[ERROR] Get Failed: %s\n", err.Error())
+		_ = connection.endSession(ctx)
+		return nil, err
+	}
+
+	defer func(Body io.ReadCloser) {
+		_ = Body.Close()
+	}(response.Body)
+
+	body, err := io.ReadAll(response.Body)
+
+	if nil != err {
+		connection.logf("[ERROR] %s\n", err)
+		connection.logf("[INFO] %s\n", redactBody(body))
+		_ = connection.endSession(ctx)
+		return nil, err
+	}
+
+	var qdoc QDocRoot
+	connection.logf("[INFO] %s\n", redactBody(body))
+	err = decodeLoginResponse(response.Header.Get("Content-Type"), body, &qdoc)
+
+	if nil != err {
+		connection.logf("[ERROR] %s\n", err)
+		connection.logf("[INFO] %s\n", redactBody(body))
+		_ = connection.endSession(ctx)
+		return nil, err
+	}
+
+	if qdoc.AuthPassed != 0 {
+		connection.mu.Lock()
+		connection.sid = qdoc.AuthSid
+		connection.expire = time.Now().Unix() + connection.timeout
+		connection.user = user
+		connection.password = password
+		connection.qdoc = &qdoc
+		connection.mu.Unlock()
+		return &qdoc, nil
+	}
+
+	if qdoc.Booting() {
+		connection.logf("[WARN] NAS is booting\n")
+		return &qdoc, ErrBooting
+	}
+
+	if qdoc.Need2SV != 0 {
+		connection.logf("[WARN] 2-step verification required\n")
+		return &qdoc, ErrOTPRequired
+	}
+
+	// forget the rejected password so ensureAuth and reauthenticate do not
+	// keep retrying it and lock the account out on QTS
+	connection.mu.Lock()
+	connection.user = ""
+	connection.password = ""
+	connection.qdoc = nil
+	connection.mu.Unlock()
+
+	connection.logf("[WARN] Auth Failed\n")
+	return &qdoc, ErrAuthFailed
+}
+
+// ensureAuth logs in again with the credentials of the last successful Login
+// once the session has expired. It is a no-op if Login was never called or
+// the NAS has since rejected the credentials, until Login succeeds again.
+func (connection *Connection) ensureAuth(ctx context.Context) {
+	if user, password := connection.credentials(); len(user) > 0 {
+		_, _ = connection.LoginContext(ctx, user, password)
+	}
+}
+
+// reauthenticate handles a NAS that dropped the session before it was due to
+// expire: if err is an authentication failure it logs in again and reports
+// whether the failed request is worth retrying.
+func (connection *Connection) reauthenticate(ctx context.Context, err error) bool {
+	var qvrError *QvrError
+	user, password := connection.credentials()
+	if len(user) == 0 || !errors.As(err, &qvrError) || !qvrError.authFailure() {
+		return false
+	}
+
+	connection.loginMu.Lock()
+	defer connection.loginMu.Unlock()
+
+	connection.clearSession()
+
+	_, err = connection.loginLocked(ctx, user, password, "")
+	return err == nil
+}
+
+// SystemStatus is the power state any client can read from authLogin.cgi
+// without logging in.
+type SystemStatus struct {
+	Booting    bool
+	MediaReady bool
+	// Shutdown is set when the NAS reports a scheduled shutdown or restart.
+	Shutdown *ScheduledShutdown
+}
+
+// ScheduledShutdown is the decoded shutdown_info block. Type is passed through
+// as the NAS reports it.
+type ScheduledShutdown struct {
+	Type     int64
+	At       time.Time
+	Duration time.Duration
+}
+
+func (connection *Connection) Status() (*SystemStatus, error) {
+	return connection.StatusContext(context.Background())
+}
+
+// StatusContext reports whether the NAS is still booting and whether its
+// media is ready for playback. It neither needs nor touches the session.
+func (connection *Connection) StatusContext(ctx context.Context) (*SystemStatus, error) {
+	qdoc, err := connection.anonymousAuthInfo(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	status := &SystemStatus{
+		Booting:    qdoc.Booting(),
+		MediaReady: qdoc.MediaIsReady(),
+	}
+
+	info := qdoc.ShutdownInfo
+	if info.Type != 0 || info.TimeStamp != 0 {
+		status.Shutdown = &ScheduledShutdown{
+			Type:     info.Type,
+			At:       time.Unix(info.TimeStamp, 0),
+			Duration: time.Duration(info.Duration) * time.Second,
+		}
+	}
+
+	return status, nil
+}
+
+// defaultReadyPoll is how often WaitForReady asks when not told.
+const defaultReadyPoll = 5 * time.Second
+
+// WaitForReady polls Status every poll, defaultReadyPoll when not positive,
+// until the NAS has booted and its media is ready, e.g. after a restart. The
+// NAS not answering at all is expected while it reboots and only logged. When
+// ctx ends first, ctx.Err() is returned along with the last status error.
+func (connection *Connection) WaitForReady(ctx context.Context, poll time.Duration) error {
+	if poll <= 0 {
+		poll = defaultReadyPoll
+	}
+
+	ticker := time.NewTicker(poll)
+	defer ticker.Stop()
+
+	var lastErr error
+	for {
+		status, err := connection.StatusContext(ctx)
+		switch {
+		case err != nil:
+			lastErr = err
+			connection.logf("[INFO] NAS not reachable yet: %s\n", err.Error())
+		case !status.Booting && status.MediaReady:
+			return nil
+		default:
+			lastErr = nil
+		}
+
+		select {
+		case <-ctx.Done():
+			if lastErr != nil {
+				return fmt.Errorf("%w (last status error: %v)", ctx.Err(), lastErr)
+			}
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// anonymousAuthInfo fetches authLogin.cgi without credentials, which the NAS
+// answers with its public state.
+func (connection *Connection) anonymousAuthInfo(ctx context.Context) (*QDocRoot, error) {
+	baseUrl, err := connection.resolve("/cgi-bin/authLogin.cgi")
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := connection.get(ctx, baseUrl)
+	if err != nil {
+		return nil, err
+	}
+
+	defer func(Body io.ReadCloser) {
+		_ = Body.Close()
+	}(response.Body)
+
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var qdoc QDocRoot
+	if err := decodeLoginResponse(response.Header.Get("Content-Type"), body, &qdoc); err != nil {
+		return nil, err
+	}
+
+	return &qdoc, nil
+}
+
+// SystemInfo identifies the NAS and its firmware. QTS publishes no serial
+// number or QVR application version without an admin-only endpoint, so
+// neither is included.
+type SystemInfo struct {
+	Hostname        string
+	Model           string
+	DisplayModel    string
+	Platform        string
+	FirmwareVersion string
+	FirmwareBuild   string
+	FirmwareNumber  string
+	Application     QvrApplication
+}
+
+func (connection *Connection) SystemInfo() (*SystemInfo, error) {
+	return connection.SystemInfoContext(context.Background())
+}
+
+// SystemInfoContext reads the model and firmware blocks QTS includes in the
+// authLogin.cgi response. It needs no session.
+func (connection *Connection) SystemInfoContext(ctx context.Context) (*SystemInfo, error) {
+	qdoc, err := connection.anonymousAuthInfo(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return &SystemInfo{
+		Hostname:        qdoc.Hostname,
+		Model:           qdoc.Model.ModelName,
+		DisplayModel:    qdoc.Model.DisplayModelName,
+		Platform:        qdoc.Model.Platform,
+		FirmwareVersion: qdoc.Firmware.Version,
+		FirmwareBuild:   qdoc.Firmware.Build,
+		FirmwareNumber:  qdoc.Firmware.Number,
+		Application:     connection.Application(),
+	}, nil
+}
+
+var ErrNotLoggedIn = errors.New("qvrpro: not logged in")
+var ErrSessionRevoked = errors.New("qvrpro: session is no longer valid")
+
+func (connection *Connection) RefreshSession() error {
+	return connection.RefreshSessionContext(context.Background())
+}
+
+// RefreshSessionContext checks the current sid with authLogin.cgi and, if the
+// NAS still accepts it, pushes the expiry out by the session timeout without
+// sending the password again. A revoked session is cleared and reported as
+// ErrSessionRevoked; the remembered credentials are kept, so the next call
+// logs in again as usual.
+func (connection *Connection) RefreshSessionContext(ctx context.Context) error {
+	connection.loginMu.Lock()
+	defer connection.loginMu.Unlock()
+
+	qdoc, err := connection.checkSession(ctx)
+	if errors.Is(err, ErrSessionRevoked) {
+		connection.clearSession()
+	}
+	if err != nil {
+		return err
+	}
+
+	connection.mu.Lock()
+	if len(qdoc.AuthSid) > 0 {
+		connection.sid = qdoc.AuthSid
+	}
+	connection.expire = time.Now().Unix() + connection.timeout
+	connection.mu.Unlock()
+
+	return nil
+}
+
+// Ping checks that the NAS is reachable and still accepts the session, e.g.
+// for a health check. It returns ErrNotLoggedIn without a session,
+// ErrSessionRevoked when the NAS rejects the sid and the network or HTTP error
+// when the NAS does not answer. Unlike RefreshSession it changes nothing, not
+// even the expiry, and never logs in.
+func (connection *Connection) Ping(ctx context.Context) error {
+	_, err := connection.checkSession(ctx)
+	return err
+}
+
+// checkSession asks authLogin.cgi whether the current sid is still valid.
+func (connection *Connection) checkSession(ctx context.Context) (*QDocRoot, error) {
+	sid := connection.Sid()
+	if len(sid) == 0 {
+		return nil, ErrNotLoggedIn
+	}
+
+	baseUrl, err := connection.resolve("/cgi-bin/authLogin.cgi")
+	if err != nil {
+		return nil, err
+	}
+
+	params := url.Values{}
+	params.Add("sid", sid)
+
+	baseUrl.RawQuery = params.Encode()
+	response, err := connection.get(ctx, baseUrl)
+	if err != nil {
+		return nil, err
+	}
+
+	defer func(Body io.ReadCloser) {
+		_ = Body.Close()
+	}(response.Body)
+
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	connection.logf("[INFO] %s\n", redactBody(body))
+
+	var qdoc QDocRoot
+	if err := decodeLoginResponse(response.Header.Get("Content-Type"), body, &qdoc); err != nil {
+		return nil, err
+	}
+
+	if qdoc.AuthPassed == 0 {
+		return nil, ErrSessionRevoked
+	}
+
+	return &qdoc, nil
+}
+
+func (connection *Connection) CameraList() ([]byte, error) {
+	return connection.CameraListContext(context.Background())
+}
+
+// CameraListRequest builds the request CameraList sends, signed with the
+// current session id, without sending it or logging in.
+func (connection *Connection) CameraListRequest(ctx context.Context) (*http.Request, error) {
+	params := url.Values{}
+	params.Add("sid", connection.Sid())
+	params.Add("ver", connection.apiVersion)
+
+	return connection.apiRequest(ctx, connection.CameraListPath(), params)
+}
+
+func (connection *Connection) CameraListContext(ctx context.Context) ([]byte, error) {
+	_, body, err := connection.CameraListWithResponseContext(ctx)
+	return body, err
+}
+
+func (connection *Connection) CameraListWithResponse() (*ResponseMeta, []byte, error) {
+	return connection.CameraListWithResponseContext(context.Background())
+}
+
+// CameraListWithResponseContext is CameraListContext that also returns what the
+// NAS answered besides the body.
+func (connection *Connection) CameraListWithResponseContext(ctx context.Context) (*ResponseMeta, []byte, error) {
+	connection.ensureAuth(ctx)
+
+	request, err := connection.CameraListRequest(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return connection.fetch(request)
+}
+
+//goland:noinspection GoUnusedConst
+const (
+	CameraConnected       = "NVR_CAM_CONNECTED"
+	CameraConnectionError = "NVR_CAM_CONNECTION_ERROR"
+	CameraConnecting      = "NVR_CAM_CONNECTING"
+	CameraConnectIdle     = "NVR_CAM_CONNECT_IDLE"
+	CameraDisconnected    = "NVR_CAM_DISCONNECTED"
+	CameraNonLicensed     = "NVR_CAM_NON_LICENSED"
+	CameraUndefined       = "NVR_CAM_UNDEFINED"
+)
+
+//goland:noinspection GoUnusedConst
+const (
+	RecStateRecording          = "RECORDING"
+	RecStateNotSetting         = "NOT_SETTING"
+	RecStateNotRecording       = "NOT_RECORDING"
+	RecStateRecordingWithSpare = "RECORDING_WITH_SPARE"
+)
+
+type StreamState struct {
+	Stream                 int    `json:"stream"`
+	EnableNormalRecording  int    `json:"enable_normal_recording"`
+	EnableAlarmRecording   int    `json:"enable_alarm_recording"`
+	VideoCodecSetting      string `json:"video_codec_setting"`
+	VideoResolutionSetting string `json:"video_resolution_setting"`
+	FrameRateSetting       string `json:"frame_rate_setting"`
+	VideoQualitySetting    string `json:"video_quality_setting"`
+	Status                 string `json:"status"`
+	RecState               string `json:"rec_state"`
+	RecStateErrCode        int    `json:"rec_state_err_code"`
+	FrameRate              string `json:"frame_rate"`
+	BitRate                int64  `json:"bit_rate"`
+}
+
+// Camera is one channel from camera/list. GUID is the channel id used by the
+// other camera, play and streaming calls, and matches LogEntry.GlobalChannelID.
+type Camera struct {
+	ChannelIndex           int           `json:"channel_index"`
+	Name                   string        `json:"name"`
+	UMSID                  string        `json:"umsid"`
+	GUID                   string        `json:"guid"`
+	Brand                  string        `json:"brand"`
+	Model                  string        `json:"model"`
+	MAC                    string        `json:"mac"`
+	Version                string        `json:"ver"`
+	IP                     string        `json:"ip"`
+	Port                   string        `json:"port"`
+	VideoCodecSetting      string        `json:"video_codec_setting"`
+	VideoResolutionSetting string        `json:"video_resolution_setting"`
+	FrameRateSetting       string        `json:"frame_rate_setting"`
+	VideoQualitySetting    string        `json:"video_quality_setting"`
+	StreamState            []StreamState `json:"stream_state"`
+	Status                 string        `json:"status"`
+	RecState               string        `json:"rec_state"`
+	RecStateErrCode        int           `json:"rec_state_err_code"`
+	FrameRate              string        `json:"frame_rate"`
+	BitRate                int64         `json:"bit_rate"`
+}
+
+type CameraListResponse struct {
+	Success         bool     `json:"success"`
+	Data            []Camera `json:"data"`
+	TotalChannelNum int      `json:"total_channel_num"`
+	ErrorCode       int64    `json:"error_code"`
+}
+
+func (camera *Camera) Connected() bool {
+	return camera.Status == CameraConnected
+}
+
+func (camera *Camera) Recording() bool {
+	return camera.RecState == RecStateRecording || camera.RecState == RecStateRecordingWithSpare
+}
+
+// Enabled reports whether normal or alarm recording is switched on for any of
+// the camera's streams.
+func (camera *Camera) Enabled() bool {
+	for _, stream := range camera.StreamState {
+		if stream.EnableNormalRecording != 0 || stream.EnableAlarmRecording != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (connection *Connection) CameraListParsed() ([]Camera, error) {
+	return connection.CameraListParsedContext(context.Background())
+}
+
+func (connection *Connection) CameraListParsedContext(ctx context.Context) ([]Camera, error) {
+	body, err := connection.CameraListContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var cameraList CameraListResponse
+	err = json.Unmarshal(body, &cameraList)
+	if err != nil {
+		return nil, err
+	}
+
+	if !cameraList.Success {
+		return nil, newApiError(cameraList.ErrorCode, body)
+	}
+
+	return cameraList.Data, nil
+}
+
+// CameraSortField selects the order CameraListFiltered returns cameras in.
+type CameraSortField int
+
+//goland:noinspection GoUnusedConst
+const (
+	CameraUnsorted CameraSortField = iota
+	CameraSortByName
+	CameraSortByChannel
+)
+
+// CameraQuery narrows down CameraListFiltered. EnabledOnly keeps cameras with
+// recording set up (see Camera.Enabled), RecordingOnly those recording right
+// now. Names are compared without regard to case.
+type CameraQuery struct {
+	EnabledOnly   bool
+	RecordingOnly bool
+	SortBy        CameraSortField
+}
+
+func (connection *Connection) CameraListFiltered(query CameraQuery) ([]Camera, error) {
+	return connection.CameraListFilteredContext(context.Background(), query)
+}
+
+// CameraListFilteredContext is CameraListParsedContext with query applied to
+// the result. camera/list has no filter or sort parameters, so the work is
+// done here after the full list arrived.
+func (connection *Connection) CameraListFilteredContext(ctx context.Context, query CameraQuery) ([]Camera, error) {
+	cameras, err := connection.CameraListParsedContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	filtered := cameras[:0]
+	for _, camera := range cameras {
+		if query.EnabledOnly && !camera.Enabled() {
+			continue
+		}
+		if query.RecordingOnly && !camera.Recording() {
+			continue
+		}
+		filtered = append(filtered, camera)
+	}
+
+	switch query.SortBy {
+	case CameraSortByName:
+		sort.SliceStable(filtered, func(i, j int) bool {
+			return strings.ToLower(filtered[i].Name) < strings.ToLower(filtered[j].Name)
+		})
+	case CameraSortByChannel:
+		sort.SliceStable(filtered, func(i, j int) bool {
+			return filtered[i].ChannelIndex < filtered[j].ChannelIndex
+		})
+	}
+
+	return filtered, nil
+}
+
+// CameraState is the health of a channel as CameraStatus reports it.
+// RecStateErrCode is non-zero when recording failed.
+type CameraState struct {
+	Online          bool
+	Recording       bool
+	Status          string
+	RecState        string
+	RecStateErrCode int
+}
+
+func (connection *Connection) CameraStatus() (map[string]CameraState, error) {
+	return connection.CameraStatusContext(context.Background())
+}
+
+// CameraStatusContext maps each channel's GUID to its connection and
+// recording state. The API has no status-only endpoint, so this still fetches
+// camera/list, but decodes only the state fields of each channel; camera/list
+// does not carry the capabilities, which stay with CameraCapability.
+func (connection *Connection) CameraStatusContext(ctx context.Context) (map[string]CameraState, error) {
+	body, err := connection.CameraListContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var cameraList struct {
+		Success   bool  `json:"success"`
+		ErrorCode int64 `json:"error_code"`
+		Data      []struct {
+			GUID            string `json:"guid"`
+			Status          string `json:"status"`
+			RecState        string `json:"rec_state"`
+			RecStateErrCode int    `json:"rec_state_err_code"`
+		} `json:"data"`
+	}
+	err = json.Unmarshal(body, &cameraList)
+	if err != nil {
+		return nil, err
+	}
+
+	if !cameraList.Success {
+		return nil, newApiError(cameraList.ErrorCode, body)
+	}
+
+	states := make(map[string]CameraState, len(cameraList.Data))
+	for _, camera := range cameraList.Data {
+		states[camera.GUID] = CameraState{
+			Online:          camera.Status == CameraConnected,
+			Recording:       camera.RecState == RecStateRecording || camera.RecState == RecStateRecordingWithSpare,
+			Status:          camera.Status,
+			RecState:        camera.RecState,
+			RecStateErrCode: camera.RecStateErrCode,
+		}
+	}
+
+	return states, nil
+}
+
+func (connection *Connection) CameraCapability() ([]byte, error) {
+	return connection.CameraCapabilityContext(context.Background())
+}
+
+// CameraCapabilityRequest builds the request CameraCapability sends, signed
+// with the current session id, without sending it or logging in.
+func (connection *Connection) CameraCapabilityRequest(ctx context.Context) (*http.Request, error) {
+	params := url.Values{}
+	params.Add("sid", connection.Sid())
+	params.Add("ver", connection.apiVersion)
+	params.Add("act", "get_camera_capability")
+
+	return connection.apiRequest(ctx, connection.CameraCapabilityPath(), params)
+}
+
+func (connection *Connection) CameraCapabilityContext(ctx context.Context) ([]byte, error) {
+	_, body, err := connection.CameraCapabilityWithResponseContext(ctx)
+	return body, err
+}
+
+func (connection *Connection) CameraCapabilityWithResponse() (*ResponseMeta, []byte, error) {
+	return connection.CameraCapabilityWithResponseContext(context.Background())
+}
+
+// CameraCapabilityWithResponseContext is CameraCapabilityContext that also
+// returns what the NAS answered besides the body.
+func (connection *Connection) CameraCapabilityWithResponseContext(ctx context.Context) (*ResponseMeta, []byte, error) {
+	connection.ensureAuth(ctx)
+
+	request, err := connection.CameraCapabilityRequest(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return connection.fetch(request)
+}
+
+type CapabilityEvent struct {
+	Name  string   `json:"name"`
+	Index int      `json:"index"`
+	GUIDs []string `json:"guids"`
+}
+
+type AlarmInputChannel struct {
+	GUID   string `json:"guid"`
+	Status string `json:"status"`
+}
+
+type AlarmInputCapability struct {
+	Name  string              `json:"name"`
+	Index int                 `json:"index"`
+	GUIDs []AlarmInputChannel `json:"guids"`
+}
+
+type AlarmOutputType struct {
+	Index int `json:"index"`
+	Type  int `json:"type"`
+}
+
+type AlarmOutputCapability struct {
+	Name          string            `json:"name"`
+	GUID          string            `json:"guid"`
+	SupportMethod int               `json:"support_method"`
+	OutputType    []AlarmOutputType `json:"output_type"`
+}
+
+type IVACapability struct {
+	Name  string   `json:"name"`
+	GUIDs []string `json:"guids"`
+}
+
+type CameraControlChannel struct {
+	GUID                string `json:"guid"`
+	SupportPresetPoints bool   `json:"support_preset_points"`
+}
+
+type CameraControlCapability struct {
+	GUIDs []CameraControlChannel `json:"guids"`
+}
+
+type CameraCapabilityResponse struct {
+	Success                    bool                      `json:"success"`
+	CameraMotion               []CapabilityEvent         `json:"camera_motion"`
+	MotionManual               []string                  `json:"motion_manual"`
+	AlarmInput                 []AlarmInputCapability    `json:"alarm_input"`
+	AlarmInputManual           []string                  `json:"alarm_input_manual"`
+	AlarmPIR                   IVACapability             `json:"alarm_pir"`
+	AlarmPIRManual             []string                  `json:"alarm_pir_manual"`
+	AlarmOutput                []AlarmOutputCapability   `json:"alarm_output"`
+	IVACrossLineManual         IVACapability             `json:"iva_crossline_manual"`
+	IVAAudioDetectedManual     IVACapability             `json:"iva_audio_detected_manual"`
+	IVATamperingDetectedManual IVACapability             `json:"iva_tampering_detected_manual"`
+	IVAIntrusionDetected       IVACapability             `json:"iva_intrusion_detected"`
+	IVAIntrusionDetectedManual IVACapability             `json:"iva_intrusion_detected_manual"`
+	IVADigitalAutotrackManual  IVACapability             `json:"iva_digital_autotrack_manual"`
+	CameraControl              []CameraControlCapability `json:"cameraControl"`
+	ErrorCode                  int64                     `json:"error_code"`
+}
+
+type StreamCapability struct {
+	Stream     int
+	Codec      string
+	Resolution string
+	FrameRate  string
+	BitRate    int64
+}
+
+// ChannelCapability summarises what a single channel supports. Streams comes
+// from camera/list and is empty for channels that report no streams.
+type ChannelCapability struct {
+	GUID            string
+	Name            string
+	Streams         []StreamCapability
+	MotionDetection bool
+	AlarmInput      bool
+	AlarmOutput     bool
+	AudioDetection  bool
+	PTZ             bool
+	PresetPoints    bool
+}
+
+// Capability holds the per-channel summary keyed by channel GUID, along with
+// the decoded camera/capability response it was built from.
+type Capability struct {
+	Channels map[string]*ChannelCapability
+	Response CameraCapabilityResponse
+}
+
+func (capability *Capability) channel(guid string) *ChannelCapability {
+	channel, exists := capability.Channels[guid]
+	if !exists {
+		channel = &ChannelCapability{GUID: guid}
+		capability.Channels[guid] = channel
+	}
+	return channel
+}
+
+func (connection *Connection) CameraCapabilityParsed() (*Capability, error) {
+	return connection.CameraCapabilityParsedContext(context.Background())
+}
+
+func (connection *Connection) CameraCapabilityParsedContext(ctx context.Context) (*Capability, error) {
+	body, err := connection.CameraCapabilityContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	capability := &Capability{Channels: make(map[string]*ChannelCapability)}
+	err = json.Unmarshal(body, &capability.Response)
+	if err != nil {
+		return nil, err
+	}
+
+	if !capability.Response.Success {
+		return nil, newApiError(capability.Response.ErrorCode, body)
+	}
+
+	cameras, err := connection.CameraListParsedContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, camera := range cameras {
+		channel := capability.channel(camera.GUID)
+		channel.Name = camera.Name
+		for _, stream := range camera.StreamState {
+			channel.Streams = append(channel.Streams, StreamCapability{
+				Stream:     stream.Stream,
+				Codec:      stream.VideoCodecSetting,
+				Resolution: stream.VideoResolutionSetting,
+				FrameRate:  stream.FrameRateSetting,
+				BitRate:    stream.BitRate,
+			})
+		}
+	}
+
+	response := &capability.Response
+	for _, motion := range response.CameraMotion {
+		for _, guid := range motion.GUIDs {
+			capability.channel(guid).MotionDetection = true
+		}
+	}
+	for _, alarmInput := range response.AlarmInput {
+		for _, alarmChannel := range alarmInput.GUIDs {
+			capability.channel(alarmChannel.GUID).AlarmInput = true
+		}
+	}
+	for _, alarmOutput := range response.AlarmOutput {
+		capability.channel(alarmOutput.GUID).AlarmOutput = true
+	}
+	for _, guid := range response.IVAAudioDetectedManual.GUIDs {
+		capability.channel(guid).AudioDetection = true
+	}
+	for _, cameraControl := range response.CameraControl {
+		for _, controlChannel := range cameraControl.GUIDs {
+			channel := capability.channel(controlChannel.GUID)
+			channel.PTZ = true
+			channel.PresetPoints = controlChannel.SupportPresetPoints
+		}
+	}
+
+	// the NAS pads empty guid lists with nulls
+	delete(capability.Channels, "")
+
+	return capability, nil
+}
+
+// StreamInfo describes one stream of a channel as configured on the NAS. ID is
+// the value LiveStream expects as its streamId.
+type StreamInfo struct {
+	ID         string
+	Codec      string
+	Resolution string
+	FrameRate  string
+	Quality    string
+	BitRate    int64
+	Status     string
+}
+
+var ErrUnknownChannel = errors.New("qvrpro: unknown channel")
+
+func (connection *Connection) StreamList(channelId string) ([]StreamInfo, error) {
+	return connection.StreamListContext(context.Background(), channelId)
+}
+
+// StreamListContext lists the streams of a channel from camera/list, so a
+// caller can pick one instead of guessing stream ids.
+func (connection *Connection) StreamListContext(ctx context.Context, channelId string) ([]StreamInfo, error) {
+	if err := validateChannelID(channelId); err != nil {
+		return nil, err
+	}
+
+	cameras, err := connection.CameraListParsedContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, camera := range cameras {
+		if camera.GUID != channelId {
+			continue
+		}
+
+		streams := make([]StreamInfo, 0, len(camera.StreamState))
+		for _, stream := range camera.StreamState {
+			streams = append(streams, StreamInfo{
+				ID:         strconv.Itoa(stream.Stream),
+				Codec:      stream.VideoCodecSetting,
+				Resolution: stream.VideoResolutionSetting,
+				FrameRate:  stream.FrameRateSetting,
+				Quality:    stream.VideoQualitySetting,
+				BitRate:    stream.BitRate,
+				Status:     stream.Status,
+			})
+		}
+
+		return streams, nil
+	}
+
+	return nil, fmt.Errorf("%w %q", ErrUnknownChannel, channelId)
+}
+
+// SessionOptions selects what a play session opened by
+// CreateSessionIdWithOptions plays back. The zero value matches
+// CreateSessionId: all recordings of stream 1 by time, as JPEG frames, with no
+// end. A non-zero EndTime (UTC ms) stops playback there. Stream is sent as
+// stream_id: 0 or 1 for stream 1, 2 and 3 for streams 2 and 3, 16 for
+// recordings without a stream id and 255 for all streams.
+type SessionOptions struct {
+	QueryType     int
+	RecordingType int
+	Stream        int
+	DataType      DataType
+	EndTime       int
+}
+
+func (connection *Connection) CreateSessionId(channelId string, startTime int) (string, error) {
+	return connection.CreateSessionIdContext(context.Background(), channelId, startTime)
+}
+
+func (connection *Connection) CreateSessionIdContext(ctx context.Context, channelId string, startTime int) (string, error) {
+	return connection.CreateSessionIdWithOptionsContext(ctx, channelId, startTime, SessionOptions{})
+}
+
+func (connection *Connection) CreateSessionIdWithOptions(channelId string, startTime int, options SessionOptions) (string, error) {
+	return connection.CreateSessionIdWithOptionsContext(context.Background(), channelId, startTime, options)
+}
+
+func (connection *Connection) CreateSessionIdWithOptionsContext(ctx context.Context, channelId string, startTime int, options SessionOptions) (string, error) {
+	if err := validateChannelID(channelId); err != nil {
+		return "", err
+	}
+	if err := options.DataType.validate(); err != nil {
+		return "", err
+	}
+
+	connection.ensureAuth(ctx)
+
+	result, err := connection.createSessionId(ctx, channelId, startTime, options)
+	if connection.reauthenticate(ctx, err) {
+		result, err = connection.createSessionId(ctx, channelId, startTime, options)
+	}
+
+	if err == nil && connection.sessions != nil {
+		connection.mu.Lock()
+		connection.playChannels[result] = channelId
+		connection.mu.Unlock()
+
+		connection.sessions.OnSessionOpen(result, channelId)
+	}
+
+	return result, err
+}
+
+func (connection *Connection) createSessionId(ctx context.Context, channelId string, startTime int, options SessionOptions) (string, error) {
+	baseUrl, err := connection.resolve(connection.PlayPath())
+	if err != nil {
+		connection.logf("[ERROR] Malformed URL: %s\n", err.Error())
+		return "", err
+	}
+
+	params := url.Values{}
+	params.Add("cmd", "open")
+	params.Add("sid", connection.Sid())
+	params.Add("ver", connection.apiPlayVersion)
+
+	params.Add("ch_sid", channelId)
+	params.Add("start_time", strconv.Itoa(startTime))
+	if options.EndTime != 0 {
+		params.Add("end_time", strconv.Itoa(options.EndTime))
+	}
+	params.Add("query_type", strconv.Itoa(options.QueryType))
+	params.Add("recording_type", strconv.Itoa(options.RecordingType))
+	params.Add("stream_id", strconv.Itoa(options.Stream))
+	params.Add("data_type", strconv.Itoa(int(options.DataType)))
+
+	baseUrl.RawQuery = params.Encode()
+	response, err := connection.get(ctx, baseUrl)
+
+	if err != nil {
+		connection.logf("[ERROR] %s\n", err.Error())
+		return "", err
+	}
+
+	defer func(Body io.ReadCloser) {
+		_ = Body.Close()
+	}(response.Body)
+
+	bodyText, err := io.ReadAll(response.Body)
+	if err != nil {
+		connection.logf("[ERROR] %s\n", err.Error())
+		return "", err
+	}
+
+	v, err := splitPlayResponse(bodyText, 3)
+	if err != nil {
+		connection.logf("[ERROR] %s\n", err.Error())
+		return "", err
+	}
+
+	code, err := playResultCode(v[1])
+	if err != nil {
+		connection.logf("[ERROR] %s\n", err.Error())
+		return "", err
+	}
+
+	if code != 0 {
+		qvrError := newQvrError(code, v[1])
+		connection.logf("[ERROR] %s\n", qvrError.Message)
+		return "", qvrError
+	}
+
+	return v[2], nil
+}
+
+func (connection *Connection) PlaySeek(sessionId string, seekTime int) (bool, error) {
+	return connection.PlaySeekContext(context.Background(), sessionId, seekTime)
+}
+
+func (connection *Connection) PlaySeekContext(ctx context.Context, sessionId string, seekTime int) (bool, error) {
+	params := url.Values{}
+	params.Add("seek_time", strconv.Itoa(seekTime))
+
+	err := connection.playCommand(ctx, "seek", sessionId, params)
+	return err == nil, err
+}
+
+func (connection *Connection) PlaySeekFrame(sessionId string, seekTime int) (Frame, error) {
+	return connection.PlaySeekFrameContext(context.Background(), sessionId, seekTime)
+}
+
+// PlaySeekFrameContext seeks a session opened with DataTypeJPeg and reads the
+// frame it landed on. The NAS snaps seeks to a nearby keyframe but its seek
+// answer carries only a return code, so the frame's Timestamp is the only
+// record of the actual position. The frame is consumed like any PlayGetFrame.
+func (connection *Connection) PlaySeekFrameContext(ctx context.Context, sessionId string, seekTime int) (Frame, error) {
+	if _, err := connection.PlaySeekContext(ctx, sessionId, seekTime); err != nil {
+		return Frame{}, err
+	}
+
+	return connection.PlayGetFrameContext(ctx, sessionId)
+}
+
+func (connection *Connection) Play(sessionId string) (bool, error) {
+	return connection.PlayContext(context.Background(), sessionId)
+}
+
+func (connection *Connection) PlayContext(ctx context.Context, sessionId string) (bool, error) {
+	err := connection.playCommand(ctx, "play", sessionId, nil)
+	return err == nil, err
+}
+
+func (connection *Connection) PlayPause(sessionId string) error {
+	return connection.PlayPauseContext(context.Background(), sessionId)
+}
+
+// PlayPauseContext holds playback on the current frame; Play resumes it. A
+// session that is shutting down fails with a *QvrError whose Code is
+// 0x93010203.
+func (connection *Connection) PlayPauseContext(ctx context.Context, sessionId string) error {
+	return connection.playCommand(ctx, "pause", sessionId, nil)
+}
+
+func (connection *Connection) PlayStep(sessionId string, direction int) error {
+	return connection.PlayStepContext(context.Background(), sessionId, direction)
+}
+
+// PlayStepContext moves a session one frame forward for a positive direction
+// and one frame back for a negative one, from wherever the last seek or step
+// left it. Pause the session first to step through a still image.
+func (connection *Connection) PlayStepContext(ctx context.Context, sessionId string, direction int) error {
+	switch {
+	case direction > 0:
+		return connection.playCommand(ctx, "next_frame", sessionId, nil)
+	case direction < 0:
+		return connection.playCommand(ctx, "prev_frame", sessionId, nil)
+	}
+	return errors.New("qvrpro: step direction must not be 0")
+}
+
+// maxPlaySpeed is the fastest speed qplay.cgi accepts, 16 times normal.
+const maxPlaySpeed = 160
+
+func (connection *Connection) PlaySpeed(sessionId string, speed int) error {
+	return connection.PlaySpeedContext(context.Background(), sessionId, speed)
+}
+
+// PlaySpeedContext sets the playback speed in tenths of normal speed, so 10
+// plays at normal speed and 160 at 16 times. Negative speeds play in reverse.
+func (connection *Connection) PlaySpeedContext(ctx context.Context, sessionId string, speed int) error {
+	magnitude := speed
+	command := "ff"
+	if speed < 0 {
+		magnitude = -speed
+		command = "rew"
+	}
+
+	if magnitude < 1 || magnitude > maxPlaySpeed {
+		return fmt.Errorf("qvrpro: play speed %d out of range ±1..%d", speed, maxPlaySpeed)
+	}
+
+	// one request, so a failure cannot leave the session winding at a speed
+	// the NAS picked
+	params := url.Values{}
+	params.Add("speed", strconv.Itoa(magnitude))
+
+	return connection.playCommand(ctx, command, sessionId, params)
+}
+
+func (connection *Connection) CloseSession(sessionId string) error {
+	return connection.CloseSessionContext(context.Background(), sessionId)
+}
+
+// CloseSessionContext releases a play session opened by CreateSessionId. The
+// NAS only holds a limited number of sessions, see 0x93010007.
+func (connection *Connection) CloseSessionContext(ctx context.Context, sessionId string) error {
+	err := connection.playCommand(ctx, "close", sessionId, nil)
+
+	if connection.sessions != nil {
+		connection.mu.Lock()
+		channelId := connection.playChannels[sessionId]
+		delete(connection.playChannels, sessionId)
+		connection.mu.Unlock()
+
+		connection.sessions.OnSessionClose(sessionId, channelId, err)
+	}
+
+	return err
+}
+
+// playCommand sends a session control command to qplay.cgi, logging in again
+// once if the NAS rejects the sid.
+func (connection *Connection) playCommand(ctx context.Context, command string, sessionId string, extra url.Values) error {
+	connection.ensureAuth(ctx)
+
+	err := connection.playControl(ctx, command, sessionId, extra)
+	if connection.reauthenticate(ctx, err) {
+		err = connection.playControl(ctx, command, sessionId, extra)
+	}
+
+	return err
+}
+
+func (connection *Connection) playControl(ctx context.Context, command string, sessionId string, extra url.Values) error {
+	baseUrl, err := connection.resolve(connection.PlayPath())
+	if err != nil {
+		connection.logf("[ERROR] Malformed URL: %s\n", err.Error())
+		return err
+	}
+
+	params := url.Values{}
+	params.Add("cmd", command)
+	params.Add("sid", connection.Sid())
+	params.Add("ver", connection.apiPlayVersion)
+	params.Add("session", sessionId)
+	for key, values := range extra {
+		params[key] = values
+	}
+
+	baseUrl.RawQuery = params.Encode()
+	response, err := connection.get(ctx, baseUrl)
+
+	if err != nil {
+		return err
+	}
+
+	defer func(Body io.ReadCloser) {
+		_ = Body.Close()
+	}(response.Body)
+
+	bodyText, err := io.ReadAll(response.Body)
+	if err != nil {
+		return err
+	}
+
+	v, err := splitPlayResponse(bodyText, 2)
+	if err != nil {
+		return err
+	}
+
+	code, err := playResultCode(v[1])
+	if err != nil {
+		return err
+	}
+
+	if code != 0 {
+		qvrError := newQvrError(code, v[1])
+		connection.logf("[ERROR] %s\n", qvrError.Message)
+		return qvrError
+	}
+
+	return nil
+}
+
+//goland:noinspection GoUnusedConst
+const (
+	RecordingTypeAll           = 0
+	RecordingTypeOnlyAlarmFile = 1
+	RecordingTypeNormalFile    = 2
+)
+
+// DataType is the format a play session delivers, see PlayGet.
+type DataType int
+
+const (
+	DataTypeJPeg   DataType = 0
+	DataTypeSource DataType = 1
+)
+
+func (dataType DataType) validate() error {
+	if dataType != DataTypeJPeg && dataType != DataTypeSource {
+		return fmt.Errorf("qvrpro: unknown data type %d, want DataTypeJPeg or DataTypeSource", int(dataType))
+	}
+	return nil
+}
+
+// PlayGet
+// The response starts with a return_code line, 0 on success and negative
+// otherwise, followed by the media frame.
+// 1. If data_type (parameter in Step 1) is '0'/DataTypeJPeg (JPEG)
+// The frame is only a video frame
+// ---
+// [channel_name]\n
+// [timestamp]\n // in UTC time format
+// [jpeg image length]\n // INT
+// [jpeg data] // BINARY, binary data of length [jpeg image length]
+// ---
+// 2. If data_type (parameter in Step 1) is '1'/DataTypeSource (source format of recording files)
+// A [media frame] is either a video or an audio frame. The format of [media
+// frame] is the same as described in API "Live Streaming"; PlayGetMedia
+// decodes it.
+
+func (connection *Connection) PlayGet(writer http.ResponseWriter, sessionId string, dataType DataType) (int64, error) {
+	return connection.PlayGetContext(context.Background(), writer, sessionId, dataType)
+}
+
+// PlayGetContext proxies the session's data into writer and returns how many
+// bytes of it were written, so a caller can tell an empty answer from a
+// delivered one.
+func (connection *Connection) PlayGetContext(ctx context.Context, writer http.ResponseWriter, sessionId string, dataType DataType) (int64, error) {
+	response, err := connection.playGet(ctx, sessionId, dataType)
+	if err != nil {
+		return 0, err
+	}
+
+	defer func(Body io.ReadCloser) {
+		_ = Body.Close()
+	}(response.Body)
+
+	// set the header as per original stream
+	copyHeader(writer.Header(), response.Header)
+
+	// stream the body to the client
+	written, err := io.Copy(writer, response.Body)
+
+	connection.logf("[INFO] Bytes written %d\n", written)
+	connection.observeBytes(connection.PlayPath(), written)
+
+	return written, err
+}
+
+func (connection *Connection) playGet(ctx context.Context, sessionId string, dataType DataType) (*http.Response, error) {
+	if err := dataType.validate(); err != nil {
+		return nil, err
+	}
+
+	connection.ensureAuth(ctx)
+
+	baseUrl, err := connection.resolve(connection.PlayPath())
+	if err != nil {
+		connection.logf("[ERROR] Malformed URL: %s\n", err.Error())
+		return nil, err
+	}
+
+	params := url.Values{}
+	params.Add("cmd", "get")
+	params.Add("sid", connection.Sid())
+	params.Add("ver", connection.apiPlayVersion)
+	params.Add("session", sessionId)
+	params.Add("data_type", strconv.Itoa(int(dataType)))
+
+	baseUrl.RawQuery = params.Encode()
+	return connection.get(ctx, baseUrl)
+}
+
+// Frame is a single JPEG frame with the channel name and time the NAS sent
+// along with it.
+type Frame struct {
+	ChannelName string
+	Timestamp   time.Time
+	JPEG        []byte
+}
+
+func (connection *Connection) PlayGetFrame(sessionId string) (Frame, error) {
+	return connection.PlayGetFrameContext(context.Background(), sessionId)
+}
+
+// PlayGetFrameContext reads the next frame of a session opened with
+// DataTypeJPeg and decodes the framing described on PlayGet. A failed
+// return_code is reported as a *QvrError.
+func (connection *Connection) PlayGetFrameContext(ctx context.Context, sessionId string) (Frame, error) {
+	response, err := connection.playGet(ctx, sessionId, DataTypeJPeg)
+	if err != nil {
+		return Frame{}, err
+	}
+
+	defer func(Body io.ReadCloser) {
+		_ = Body.Close()
+	}(response.Body)
+
+	reader := bufio.NewReader(response.Body)
+	if err := readPlayResult(reader); err != nil {
+		connection.logf("[ERROR] %s\n", err.Error())
+		return Frame{}, err
+	}
+
+	return readJPegFrame(reader)
+}
+
+func readJPegFrame(reader *bufio.Reader) (Frame, error) {
+	var frame Frame
+
+	var header [3]string
+	for i := range header {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return frame, fmt.Errorf("qvrpro: malformed frame header: %w", err)
+		}
+		header[i] = strings.TrimSpace(line)
+	}
+
+	timestamp, err := strconv.ParseInt(header[1], 10, 64)
+	if err != nil {
+		return frame, fmt.Errorf("qvrpro: malformed frame timestamp %q", header[1])
+	}
+
+	length, err := strconv.Atoi(header[2])
+	if err != nil || length < 0 {
+		return frame, fmt.Errorf("qvrpro: malformed frame length %q", header[2])
+	}
+
+	frame.ChannelName = header[0]
+	frame.Timestamp = time.UnixMilli(timestamp)
+	frame.JPEG = make([]byte, length)
+
+	_, err = io.ReadFull(reader, frame.JPEG)
+	if err != nil {
+		return frame, fmt.Errorf("qvrpro: short frame data: %w", err)
+	}
+
+	return frame, nil
+}
+
+type MediaKind int
+
+//goland:noinspection GoUnusedConst
+const (
+	MediaVideo MediaKind = 0
+	MediaAudio MediaKind = 1
+)
+
+func (kind MediaKind) String() string {
+	if kind == MediaAudio {
+		return "audio"
+	}
+	return "video"
+}
+
+// MediaFrame is one frame of a source-format stream, as sent after the result
+// line by getstream.cgi and by play sessions opened with DataTypeSource. Width
+// and Height are only meaningful for video, SampleRate, BitsPerSample and
+// AudioChannels only for audio.
+type MediaFrame struct {
+	Kind          MediaKind
+	FourCC        string
+	KeyFrame      bool
+	Width         int
+	Height        int
+	Timestamp     time.Time
+	ChannelName   string
+	SampleRate    int
+	BitsPerSample int
+	AudioChannels int
+	Data          []byte
+}
+
+// audioFourCCs are the FourCC codes the API documents for audio frames.
+var audioFourCCs = map[string]bool{
+	"G726": true, "Q726": true, "FAAC": true, "G711": true,
+	"PCM": true, "0AAC": true, "A711": true, "QAAC": true,
+}
+
+// mediaHeaderSize is the size of the header shared by video and audio frames.
+const mediaHeaderSize = 56
+
+// maxMediaFrameSize rejects frame sizes no camera produces, which mean the
+// stream is out of step.
+const maxMediaFrameSize = 64 << 20
+
+// MediaReader splits a source-format stream into MediaFrames.
+type MediaReader struct {
+	reader *bufio.Reader
+	closer io.Closer
+}
+
+// NewMediaReader reads frames from reader, which must already be past the
+// result line; use NewStreamMediaReader on a getstream.cgi or qplay.cgi body.
+func NewMediaReader(reader io.Reader) *MediaReader {
+	return &MediaReader{reader: bufio.NewReader(reader)}
+}
+
+// NewStreamMediaReader consumes and checks the result line a getstream.cgi or
+// qplay.cgi get body starts with, then reads the frames that follow. A failed
+// result is returned as a *QvrError.
+func NewStreamMediaReader(reader io.Reader) (*MediaReader, error) {
+	media := NewMediaReader(reader)
+	if err := readPlayResult(media.reader); err != nil {
+		return nil, err
+	}
+
+	return media, nil
+}
+
+// ReadFrame returns the next frame, or io.EOF once the stream ended cleanly.
+func (media *MediaReader) ReadFrame() (MediaFrame, error) {
+	var frame MediaFrame
+
+	var header [mediaHeaderSize]byte
+	if _, err := io.ReadFull(media.reader, header[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return frame, fmt.Errorf("qvrpro: short media frame header: %w", err)
+		}
+		return frame, err
+	}
+
+	frame.FourCC = strings.TrimRight(string(header[0:4]), " \x00")
+	frame.KeyFrame = binary.LittleEndian.Uint32(header[4:8])&1 != 0
+	frame.Width = int(binary.LittleEndian.Uint32(header[8:12]))
+	frame.Height = int(binary.LittleEndian.Uint32(header[12:16]))
+	frame.Timestamp = time.UnixMilli(int64(binary.LittleEndian.Uint64(header[16:24])))
+	frame.ChannelName, _, _ = strings.Cut(string(header[24:48]), "\x00")
+	additional := binary.LittleEndian.Uint32(header[48:52])
+	size := binary.LittleEndian.Uint32(header[52:56])
+
+	if size > maxMediaFrameSize || additional > maxMediaFrameSize {
+		return frame, fmt.Errorf("qvrpro: implausible media frame size %d", size)
+	}
+
+	if audioFourCCs[frame.FourCC] {
+		frame.Kind = MediaAudio
+
+		var audio [8]byte
+		if _, err := io.ReadFull(media.reader, audio[:]); err != nil {
+			return frame, fmt.Errorf("qvrpro: short audio frame header: %w", err)
+		}
+		frame.SampleRate = int(binary.LittleEndian.Uint32(audio[0:4]))
+		frame.BitsPerSample = int(binary.LittleEndian.Uint16(audio[4:6]))
+		frame.AudioChannels = int(binary.LittleEndian.Uint16(audio[6:8]))
+	} else if additional > 0 {
+		if _, err := media.reader.Discard(int(additional)); err != nil {
+			return frame, fmt.Errorf("qvrpro: short additional frame header: %w", err)
+		}
+	}
+
+	frame.Data = make([]byte, size)
+	if _, err := io.ReadFull(media.reader, frame.Data); err != nil {
+		return frame, fmt.Errorf("qvrpro: short media frame data: %w", err)
+	}
+
+	return frame, nil
+}
+
+// Close releases the response the reader was opened on, if any.
+func (media *MediaReader) Close() error {
+	if media.closer == nil {
+		return nil
+	}
+	return media.closer.Close()
+}
+
+func (connection *Connection) PlayGetMedia(sessionId string) (*MediaReader, error) {
+	return connection.PlayGetMediaContext(context.Background(), sessionId)
+}
+
+// PlayGetMediaContext fetches the data of a session opened with
+// DataTypeSource and returns a reader over its video and audio frames. A
+// failed return_code is reported as a *QvrError; otherwise the caller closes
+// the reader when done.
+func (connection *Connection) PlayGetMediaContext(ctx context.Context, sessionId string) (*MediaReader, error) {
+	response, err := connection.playGet(ctx, sessionId, DataTypeSource)
+	if err != nil {
+		return nil, err
+	}
+
+	media, err := NewStreamMediaReader(response.Body)
+	if err != nil {
+		_ = response.Body.Close()
+		connection.logf("[ERROR] %s\n", err.Error())
+		return nil, err
+	}
+	media.closer = response.Body
+
+	return media, nil
+}
+
+func (connection *Connection) PlayFrame(writer http.ResponseWriter, channelId string, seekTime int) error {
+	return connection.PlayFrameContext(context.Background(), writer, channelId, seekTime)
+}
+
+func (connection *Connection) PlayFrameContext(ctx context.Context, writer http.ResponseWriter, channelId string, seekTime int) error {
+	return connection.playFrame(ctx, channelId, seekTime, func(sessionId string) error {
+		_, err := connection.PlayGetContext(ctx, writer, sessionId, DataTypeJPeg)
+		return err
+	})
+}
+
+func (connection *Connection) PlayFrameBytes(channelId string, seekTime int) ([]byte, string, error) {
+	return connection.PlayFrameBytesContext(context.Background(), channelId, seekTime)
+}
+
+// PlayFrameBytesContext is PlayFrameContext for callers without an
+// http.ResponseWriter: it returns the decoded image and its content type.
+func (connection *Connection) PlayFrameBytesContext(ctx context.Context, channelId string, seekTime int) ([]byte, string, error) {
+	var frame Frame
+	err := connection.playFrame(ctx, channelId, seekTime, func(sessionId string) error {
+		var err error
+		frame, err = connection.PlayGetFrameContext(ctx, sessionId)
+		return err
+	})
+	if err != nil {
+		return nil, "", err
+	}
+
+	return frame.JPEG, http.DetectContentType(frame.JPEG), nil
+}
+
+// playFrame opens a session on channelId at seekTime, starts playback, hands
+// the session to get and closes the session again, whichever step fails.
+// Errors name the failing stage and wrap its cause.
+func (connection *Connection) playFrame(ctx context.Context, channelId string, seekTime int, get func(sessionId string) error) error {
+
+	sessionId, err := connection.CreateSessionIdContext(ctx, channelId, seekTime)
+	if err != nil {
+		return fmt.Errorf("qvrpro: play frame: open session: %w", err)
+	}
+	if len(sessionId) == 0 {
+		return errors.New("qvrpro: play frame: open session: empty session id")
+	}
+
+	defer func() {
+		_ = connection.CloseSessionContext(context.WithoutCancel(ctx), sessionId)
+	}()
+
+	if _, err := connection.PlaySeekContext(ctx, sessionId, seekTime); err != nil {
+		return fmt.Errorf("qvrpro: play frame: seek: %w", err)
+	}
+
+	if _, err := connection.PlayContext(ctx, sessionId); err != nil {
+		return fmt.Errorf("qvrpro: play frame: play: %w", err)
+	}
+
+	if err := get(sessionId); err != nil {
+		return fmt.Errorf("qvrpro: play frame: get: %w", err)
+	}
+
+	return nil
+}
+
+// LiveStream proxies a live stream until the NAS ends it. It cannot notice
+// the client going away; HTTP handlers should call LiveStreamContext with the
+// request's context instead.
+func (connection *Connection) LiveStream(writer http.ResponseWriter, channelId string, streamId string) (int64, error) {
+	return connection.LiveStreamContext(context.Background(), writer, channelId, streamId)
+}
+
+// LiveStreamContext proxies a live stream into writer, flushing as data
+// arrives, and returns how many bytes were written; a stream the NAS ended
+// without sending anything returns 0 and no error. Cancelling ctx, e.g. the
+// context of the client's request once it disconnects, closes the upstream
+// stream and returns ctx.Err().
+func (connection *Connection) LiveStreamContext(ctx context.Context, writer http.ResponseWriter, channelId string, streamId string) (int64, error) {
+	response, err := connection.liveStream(ctx, channelId, streamId)
+	if err != nil {
+		return 0, err
+	}
+
+	defer func(Body io.ReadCloser) {
+		_ = Body.Close()
+	}(response.Body)
+
+	// a read blocked on a stalled NAS does not always notice ctx on its own
+	stop := context.AfterFunc(ctx, func() {
+		_ = response.Body.Close()
+	})
+	defer stop()
+
+	// set the header as per original stream
+	copyHeader(writer.Header(), response.Header)
+
+	// stream the body to the client
+	written, err := io.Copy(flushWriter{writer}, response.Body)
+
+	connection.logf("[INFO] Bytes written %d\n", written)
+	connection.observeBytes(connection.StreamsPath(), written)
+
+	if ctx.Err() != nil {
+		return written, ctx.Err()
+	}
+
+	return written, err
+}
+
+// flushWriter flushes after every write so a proxied stream reaches the
+// client as it arrives instead of sitting in the server's buffer.
+type flushWriter struct {
+	writer http.ResponseWriter
+}
+
+func (flush flushWriter) Write(p []byte) (int, error) {
+	n, err := flush.writer.Write(p)
+	if flusher, ok := flush.writer.(http.Flusher); ok {
+		flusher.Flush()
+	}
+	return n, err
+}
+
+// apiRequest builds a GET request for path on the NAS with params as query.
+func (connection *Connection) apiRequest(ctx context.Context, path string, params url.Values) (*http.Request, error) {
+	baseUrl, err := connection.resolve(path)
+	if err != nil {
+		return nil, err
+	}
+
+	baseUrl.RawQuery = params.Encode()
+
+	return http.NewRequestWithContext(ctx, http.MethodGet, baseUrl.String(), nil)
+}
+
+// copyHeader replaces each header in dst with all of its values from src, so
+// repeated headers such as Set-Cookie survive the copy.
+func copyHeader(dst http.Header, src http.Header) {
+	for k, v := range src {
+		dst.Del(k)
+		for _, value := range v {
+			dst.Add(k, value)
+		}
+	}
+}
+
+func (connection *Connection) liveStream(ctx context.Context, channelId string, streamId string) (*http.Response, error) {
+	if err := validateChannelID(channelId); err != nil {
+		return nil, err
+	}
+	if err := validateStreamID(streamId); err != nil {
+		return nil, err
+	}
+
+	connection.ensureAuth(ctx)
+
+	request, err := connection.LiveStreamRequest(ctx, channelId, streamId)
+	if err != nil {
+		return nil, err
+	}
+
+	return connection.doRequest(request)
+}
+
+// LiveStreamRequest builds the request LiveStream sends, signed with the
+// current session id, without sending it or logging in.
+func (connection *Connection) LiveStreamRequest(ctx context.Context, channelId string, streamId string) (*http.Request, error) {
+	if err := validateChannelID(channelId); err != nil {
+		return nil, err
+	}
+	if err := validateStreamID(streamId); err != nil {
+		return nil, err
+	}
+
+	params := url.Values{}
+	params.Add("sid", connection.Sid())
+	params.Add("ch_sid", channelId)
+	params.Add("stream_id", streamId)
+
+	return connection.apiRequest(ctx, connection.StreamsPath(), params)
+}
+
+// StreamMeta describes a live stream opened by OpenLiveStream. getstream.cgi
+// documents no metadata headers, so Codec, Resolution and BitRate are the
+// stream's settings from camera/list; ContentType and Header are what the NAS
+// answered with.
+type StreamMeta struct {
+	ContentType string
+	Header      http.Header
+	Codec       string
+	Resolution  string
+	BitRate     int64
+}
+
+var ErrUnknownStream = errors.New("qvrpro: unknown stream")
+
+// OpenLiveStream opens a live stream and returns its metadata with the body
+// unread, e.g. to refuse a codec before proxying anything, or to decode it
+// with NewStreamMediaReader. The caller must close the body; cancelling ctx
+// also ends the stream. A stream id the channel does not list fails with
+// ErrUnknownStream before the stream is opened.
+func (connection *Connection) OpenLiveStream(ctx context.Context, channelId string, streamId string) (*StreamMeta, io.ReadCloser, error) {
+	if err := validateStreamID(streamId); err != nil {
+		return nil, nil, err
+	}
+
+	streams, err := connection.StreamListContext(ctx, channelId)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var meta *StreamMeta
+	for _, stream := range streams {
+		if stream.ID == streamId {
+			meta = &StreamMeta{Codec: stream.Codec, Resolution: stream.Resolution, BitRate: stream.BitRate}
+			break
+		}
+	}
+	if meta == nil {
+		return nil, nil, fmt.Errorf("%w %q on channel %q", ErrUnknownStream, streamId, channelId)
+	}
+
+	response, err := connection.liveStream(ctx, channelId, streamId)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	meta.ContentType = response.Header.Get("Content-Type")
+	meta.Header = response.Header
+
+	return meta, response.Body, nil
+}
+
+// LiveStreamFrames opens a live stream served as multipart/x-mixed-replace
+// MJPEG and sends each part on the returned channel, stamped with the time it
+// arrived and ChannelName set to channelId. The channel is closed when the
+// stream ends, ctx is cancelled or a part cannot be read; the cause of the
+// latter is only logged. Streams in any other format are rejected before a
+// frame is read.
+func (connection *Connection) LiveStreamFrames(ctx context.Context, channelId string, streamId string) (<-chan Frame, error) {
+	response, err := connection.liveStream(ctx, channelId, streamId)
+	if err != nil {
+		return nil, err
+	}
+
+	mediaType, params, err := mime.ParseMediaType(response.Header.Get("Content-Type"))
+	if err != nil || !strings.HasPrefix(mediaType, "multipart/") || len(params["boundary"]) == 0 {
+		_ = response.Body.Close()
+		return nil, fmt.Errorf("qvrpro: live stream is %q, not multipart MJPEG", response.Header.Get("Content-Type"))
+	}
+
+	frames := make(chan Frame)
+	go func() {
+		defer close(frames)
+		defer func(Body io.ReadCloser) {
+			_ = Body.Close()
+		}(response.Body)
+
+		reader := multipart.NewReader(response.Body, params["boundary"])
+		for {
+			part, err := reader.NextPart()
+			if err != nil {
+				if err != io.EOF && ctx.Err() == nil {
+					connection.logf("[ERROR] %s\n", err)
+				}
+				return
+			}
+
+			jpeg, err := io.ReadAll(part)
+			if err != nil {
+				if ctx.Err() == nil {
+					connection.logf("[ERROR] %s\n", err)
+				}
+				return
+			}
+
+			frame := Frame{ChannelName: channelId, Timestamp: time.Now(), JPEG: jpeg}
+			select {
+			case frames <- frame:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return frames, nil
+}
+
+// LogEntry is one entry of logs/logs. Surveillance events carry their EventID,
+// but the QVR Pro API has no call to acknowledge or clear an event, so events
+// can only be read here.
+type LogEntry struct {
+	UTCTime         int64          `json:"UTC_time"`
+	UTCTimeS        string         `json:"UTC_time_s"`
+	Content         string         `json:"content"`
+	Level           int            `json:"level"`
+	LogID           int            `json:"log_id"`
+	LogType         int            `json:"log_type"`
+	NasIP           string         `json:"nas_ip"`
+	NasName         string         `json:"nas_name"`
+	ServerTime      int64          `json:"server_time"`
+	SourceIP        string         `json:"source_ip"`
+	SourceName      string         `json:"source_name"`
+	Time            string         `json:"time"`
+	Timezone        string         `json:"timezone"`
+	TimezoneOrder   int            `json:"timezone_order"`
+	User            string         `json:"user"`
+	Action          string         `json:"action,omitempty"`
+	Args            []string       `json:"args,omitempty"`
+	ChannelID       int            `json:"channel_id,omitempty"`
+	EventID         int            `json:"event_id,omitempty"`
+	GlobalChannelID string         `json:"global_channel_id,omitempty"`
+	MainType        int            `json:"main_type,omitempty"`
+	SubType         int            `json:"sub_type,omitempty"`
+	SubTypeOrder    int            `json:"sub_type_order,omitempty"`
+	Application     QvrApplication `json:"application,omitempty"`
+}
+
+type LogsResponse struct {
+	Code          int        `json:"code"`
+	Items         []LogEntry `json:"items"`
+	Mesg          string     `json:"mesg"`
+	ResponseItems int        `json:"responseItems"`
+	TotalItems    int        `json:"totalItems"`
+}
+
+//goland:noinspection GoUnusedConst
+const (
+	AllLogType                     = 0
+	SystemEventsLogType            = 1
+	SystemConnectionsLogType       = 2
+	SurveillanceEventsLogType      = 3
+	SurveillanceConnectionsLogType = 4
+	SurveillanceSettingsLogType    = 5
+)
+
+// LogLevel is the severity of a log entry.
+type LogLevel int
+
+//goland:noinspection GoUnusedConst
+const (
+	LevelInfo    LogLevel = 0
+	LevelWarning LogLevel = 1
+	LevelError   LogLevel = 2
+)
+
+func (level LogLevel) String() string {
+	switch level {
+	case LevelInfo:
+		return "info"
+	case LevelWarning:
+		return "warning"
+	case LevelError:
+		return "error"
+	}
+	return fmt.Sprintf("level(%d)", int(level))
+}
+
+// LogKind is the category of a log entry, one of the *LogType constants.
+type LogKind uint
+
+func (kind LogKind) String() string {
+	switch kind {
+	case SystemEventsLogType:
+		return "system events"
+	case SystemConnectionsLogType:
+		return "system connections"
+	case SurveillanceEventsLogType:
+		return "surveillance events"
+	case SurveillanceConnectionsLogType:
+		return "surveillance connections"
+	case SurveillanceSettingsLogType:
+		return "surveillance settings"
+	}
+	return fmt.Sprintf("log type(%d)", uint(kind))
+}
+
+func (entry *LogEntry) Severity() LogLevel {
+	return LogLevel(entry.Level)
+}
+
+// EventKind returns the category of the entry. MainType and SubType refine it
+// further, but their values are not documented by QNAP and are left raw.
+func (entry *LogEntry) EventKind() LogKind {
+	return LogKind(entry.LogType)
+}
+
+func (connection *Connection) Logs(logType uint, startTime int64, maxResults int) ([]LogEntry, error) {
+	return connection.LogsContext(context.Background(), logType, startTime, maxResults)
+}
+
+// LogsContext returns up to maxResults entries of logType from startTime on.
+// It drops the counts the NAS sends along; LogsPage with the same LogQuery
+// returns the whole LogsResponse, whose TotalItems tells whether maxResults
+// cut the list short.
+func (connection *Connection) LogsContext(ctx context.Context, logType uint, startTime int64, maxResults int) ([]LogEntry, error) {
+	qvrResponse, err := connection.LogsPageContext(ctx, LogQuery{
+		LogType:    logType,
+		StartTime:  startTime,
+		MaxResults: maxResults,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return qvrResponse.Items, nil
+}
+
+func (connection *Connection) LogsMulti(logTypes []uint, startTime int64, maxResults int) ([]LogEntry, error) {
+	return connection.LogsMultiContext(context.Background(), logTypes, startTime, maxResults)
+}
+
+// LogsMultiContext fetches the logs of several types at once and merges them
+// into one list ordered by time, keeping the first maxResults. An entry found
+// under more than one type, e.g. when AllLogType is among them, appears once.
+// The first failing type fails the whole call.
+func (connection *Connection) LogsMultiContext(ctx context.Context, logTypes []uint, startTime int64, maxResults int) ([]LogEntry, error) {
+	connection.ensureAuth(ctx)
+
+	pages := make([][]LogEntry, len(logTypes))
+	errs := make([]error, len(logTypes))
+
+	var wg sync.WaitGroup
+	for i, logType := range logTypes {
+		wg.Add(1)
+		go func(i int, logType uint) {
+			defer wg.Done()
+			pages[i], errs[i] = connection.LogsContext(ctx, logType, startTime, maxResults)
+		}(i, logType)
+	}
+	wg.Wait()
+
+	type entryKey struct {
+		logType int
+		logID   int
+	}
+	seen := make(map[entryKey]bool)
+
+	var entries []LogEntry
+	for i, page := range pages {
+		if errs[i] != nil {
+			return nil, errs[i]
+		}
+		for _, entry := range page {
+			key := entryKey{entry.LogType, entry.LogID}
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			entries = append(entries, entry)
+		}
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].UTCTime < entries[j].UTCTime
+	})
+
+	if maxResults > 0 && len(entries) > maxResults {
+		entries = entries[:maxResults]
+	}
+
+	return entries, nil
+}
+
+// LogQuery selects a page of logs. Start is the index of the first entry to
+// return. SortField is one of logSortFields and Dir is SortAscending or
+// SortDescending; they default to "time" and "ASC". Zero values of the
+// filters leave them off: MinLevel 0 returns every level, an empty User every
+// user, and EndTime 0 has no upper bound.
+type LogQuery struct {
+	LogType   uint
+	StartTime int64
+	EndTime   int64
+	MinLevel  int
+	User      string
+	// GlobalChannelIDs restricts the logs to the given channels (GUIDs)
+	GlobalChannelIDs []string
+	Start            int
+	MaxResults       int
+	SortField        string
+	Dir              string
+}
+
+const (
+	SortAscending  = "ASC"
+	SortDescending = "DESC"
+)
+
+// logSortFields are the fields logs/logs can sort by.
+var logSortFields = []string{"log_id", "log_type", "level", "time", "direction"}
+
+func (query *LogQuery) validateSort() error {
+	if len(query.SortField) > 0 && !slices.Contains(logSortFields, query.SortField) {
+		return fmt.Errorf("qvrpro: cannot sort logs by %q, want one of %s", query.SortField, strings.Join(logSortFields, ", "))
+	}
+	if len(query.Dir) > 0 && query.Dir != SortAscending && query.Dir != SortDescending {
+		return fmt.Errorf("qvrpro: log sort direction %q is neither %s nor %s", query.Dir, SortAscending, SortDescending)
+	}
+	return nil
+}
+
+// highestLogLevel is the most severe level the NAS reports.
+const highestLogLevel = int(LevelError)
+
+func (query *LogQuery) levels() string {
+	var levels []string
+	for level := query.MinLevel; level <= highestLogLevel; level++ {
+		levels = append(levels, strconv.Itoa(level))
+	}
+	return strings.Join(levels, ",")
+}
+
+func (connection *Connection) LogsPage(query LogQuery) (LogsResponse, error) {
+	return connection.LogsPageContext(context.Background(), query)
+}
+
+// LogsRequest builds the request LogsPage sends for query, signed with the
+// current session id, without sending it or logging in.
+func (connection *Connection) LogsRequest(ctx context.Context, query LogQuery) (*http.Request, error) {
+	if err := query.validateSort(); err != nil {
+		return nil, err
+	}
+
+	sortField := query.SortField
+	if len(sortField) == 0 {
+		sortField = "time"
+	}
+	dir := query.Dir
+	if len(dir) == 0 {
+		dir = SortAscending
+	}
+
+	params := url.Values{}
+	params.Add("sid", connection.Sid())
+	if AllLogType != query.LogType {
+		params.Add("log_type", strconv.Itoa(int(query.LogType)))
+	}
+	if query.StartTime != 0 {
+		params.Add("start_time", strconv.FormatInt(query.StartTime, 10))
+	}
+	if query.EndTime != 0 {
+		params.Add("end_time", strconv.FormatInt(query.EndTime, 10))
+	}
+	if query.MinLevel > 0 {
+		params.Add("level", query.levels())
+	}
+	if len(query.User) > 0 {
+		params.Add("user", query.User)
+	}
+	if len(query.GlobalChannelIDs) > 0 {
+		params.Add("global_channel_id", strings.Join(query.GlobalChannelIDs, ","))
+	}
+	if query.Start != 0 {
+		params.Add("start", strconv.Itoa(query.Start))
+	}
+	params.Add("sort_field", sortField)
+	params.Add("max_results", strconv.Itoa(query.MaxResults))
+	params.Add("dir", dir)
+
+	return connection.apiRequest(ctx, connection.LogsPath(), params)
+}
+
+// LogsPageContext fetches a single page of logs. TotalItems in the response
+// tells how many entries match overall, so callers can keep advancing
+// query.Start until it is reached.
+func (connection *Connection) LogsPageContext(ctx context.Context, query LogQuery) (LogsResponse, error) {
+	connection.ensureAuth(ctx)
+
+	var qvrResponse LogsResponse
+
+	request, err := connection.LogsRequest(ctx, query)
+	if err != nil {
+		return qvrResponse, err
+	}
+
+	response, err := connection.doRequest(request)
+
+	if err != nil {
+		return qvrResponse, err
+	}
+
+	defer func(Body io.ReadCloser) {
+		_ = Body.Close()
+	}(response.Body)
+
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		return qvrResponse, err
+	}
+
+	err = json.Unmarshal(body, &qvrResponse)
+	if err != nil {
+		return qvrResponse, err
+	}
+
+	for i := range qvrResponse.Items {
+		qvrResponse.Items[i].Application = connection.Application()
+	}
+
+	return qvrResponse, nil
+}
+
+// logsPageSize is how many log entries are asked for per request when walking
+// every page of a query.
+const logsPageSize = 100
+
+func (connection *Connection) LogsIterator(query LogQuery, yield func(LogEntry) bool) error {
+	return connection.LogsIteratorContext(context.Background(), query, yield)
+}
+
+// LogsIteratorContext walks every page matching query, starting at
+// query.Start, and calls yield for each entry until it returns false or the
+// entries run out. query.MaxResults sets the page size, logsPageSize when 0.
+func (connection *Connection) LogsIteratorContext(ctx context.Context, query LogQuery, yield func(LogEntry) bool) error {
+	if query.MaxResults <= 0 {
+		query.MaxResults = logsPageSize
+	}
+
+	for {
+		page, err := connection.LogsPageContext(ctx, query)
+		if err != nil {
+			return err
+		}
+
+		for _, entry := range page.Items {
+			if !yield(entry) {
+				return nil
+			}
+		}
+
+		query.Start += len(page.Items)
+		if len(page.Items) == 0 || query.Start >= page.TotalItems {
+			return nil
+		}
+	}
+}
+
+// Timeline tells which slots of a day have recordings. Recorded[i] covers
+// the slot starting at Start plus i times Slot.
+type Timeline struct {
+	Start    time.Time
+	Slot     time.Duration
+	Recorded []bool
+}
+
+// TimelineInterval is a run of consecutive recorded slots.
+type TimelineInterval struct {
+	Start time.Time
+	End   time.Time
+}
+
+// Intervals merges the recorded slots into runs, e.g. for a scrub bar.
+func (timeline *Timeline) Intervals() []TimelineInterval {
+	var intervals []TimelineInterval
+	for i, recorded := range timeline.Recorded {
+		if !recorded {
+			continue
+		}
+
+		start := timeline.Start.Add(time.Duration(i) * timeline.Slot)
+		end := start.Add(timeline.Slot)
+		if n := len(intervals); n > 0 && intervals[n-1].End.Equal(start) {
+			intervals[n-1].End = end
+		} else {
+			intervals = append(intervals, TimelineInterval{Start: start, End: end})
+		}
+	}
+	return intervals
+}
+
+// errNoFilesFound is the code qplay.cgi answers with for a time range without
+// recordings.
+const errNoFilesFound uint32 = 0x93010204
+
+func (connection *Connection) RecordingTimeline(channelId string, date time.Time) (*Timeline, error) {
+	return connection.RecordingTimelineContext(context.Background(), channelId, date)
+}
+
+// RecordingTimelineContext reports which hours of the day containing date, in
+// date's location, have recordings on a channel. QVR Pro publishes no
+// recording index, so each hour is probed by opening a play session for it:
+// an hour the NAS answers with 0x93010204 "no files found" is empty, one it
+// opens is recorded and the session is closed before the next hour is probed.
+// That is 24 sessions in a row per call, so cache the result rather than
+// polling it. If a probe fails, the timeline of the hours probed so far is
+// returned along with the error.
+func (connection *Connection) RecordingTimelineContext(ctx context.Context, channelId string, date time.Time) (*Timeline, error) {
+	if err := validateChannelID(channelId); err != nil {
+		return nil, err
+	}
+
+	year, month, day := date.Date()
+	timeline := &Timeline{
+		Start:    time.Date(year, month, day, 0, 0, 0, 0, date.Location()),
+		Slot:     time.Hour,
+		Recorded: make([]bool, 0, 24),
+	}
+
+	end := timeline.Start.AddDate(0, 0, 1)
+	for slot := timeline.Start; slot.Before(end); slot = slot.Add(timeline.Slot) {
+		recorded, err := connection.probeRecording(ctx, channelId, slot, slot.Add(timeline.Slot), RecordingTypeAll)
+		if err != nil && !recorded {
+			return timeline, err
+		}
+
+		timeline.Recorded = append(timeline.Recorded, recorded)
+		if err != nil {
+			return timeline, err
+		}
+	}
+
+	return timeline, nil
+}
+
+// errSessionFull is the code qplay.cgi answers with while all play sessions
+// the NAS allows are open.
+const errSessionFull uint32 = 0x93010007
+
+// sessionFullRetries is how often probeRecording waits sessionFullWait for a
+// play session to be freed before it gives up.
+const (
+	sessionFullRetries = 3
+	sessionFullWait    = 500 * time.Millisecond
+)
+
+// probeRecording reports whether a channel has recordings of recordingType
+// between from and to by opening a play session for that range, which the NAS
+// refuses with 0x93010204 when there are none. The session is closed before
+// probeRecording returns.
+func (connection *Connection) probeRecording(ctx context.Context, channelId string, from time.Time, to time.Time, recordingType int) (bool, error) {
+	options := SessionOptions{RecordingType: recordingType, EndTime: int(to.UnixMilli())}
+
+	for retry := 0; ; retry++ {
+		sessionId, err := connection.CreateSessionIdWithOptionsContext(ctx, channelId, int(from.UnixMilli()), options)
+
+		var qvrError *QvrError
+		switch {
+		case errors.As(err, &qvrError) && qvrError.Code == errNoFilesFound:
+			return false, nil
+		case errors.As(err, &qvrError) && qvrError.Code == errSessionFull && retry < sessionFullRetries:
+			connection.logf("[WARN] Play sessions full, retrying in %s\n", sessionFullWait)
+
+			timer := time.NewTimer(sessionFullWait)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return false, ctx.Err()
+			case <-timer.C:
+			}
+		case err != nil:
+			return false, err
+		default:
+			// a session left open would count against the next probe
+			return true, connection.CloseSessionContext(context.WithoutCancel(ctx), sessionId)
+		}
+	}
+}
+
+var ErrUnknownTimezone = errors.New("qvrpro: NAS timezone unknown")
+
+// gmtOffsetPattern matches the offset in QTS timezone names such as
+// "(GMT+08:00) Beijing, Chongqing, Hong Kong, Urumqi".
+var gmtOffsetPattern = regexp.MustCompile(`GMT([+-])(\d{2}):(\d{2})`)
+
+// parseTimezone turns the timezone of a log entry, either an IANA name like
+// "Asia/Taipei" or a QTS display name with a GMT offset, into a location.
+func parseTimezone(timezone string) (*time.Location, bool) {
+	if location, err := time.LoadLocation(timezone); err == nil && len(timezone) > 0 {
+		return location, true
+	}
+
+	match := gmtOffsetPattern.FindStringSubmatch(timezone)
+	if match == nil {
+		return nil, false
+	}
+
+	hours, _ := strconv.Atoi(match[2])
+	minutes, _ := strconv.Atoi(match[3])
+	offset := hours*3600 + minutes*60
+	if match[1] == "-" {
+		offset = -offset
+	}
+
+	return time.FixedZone(strings.TrimSpace(timezone), offset), true
+}
+
+func (connection *Connection) ServerTime() (time.Time, *time.Location, error) {
+	return connection.ServerTimeContext(context.Background())
+}
+
+// ServerTimeContext returns the NAS clock, to the second, and its timezone.
+// No API reports either directly: the time is the Date header of a logs/logs
+// answer and the timezone that of the newest log entry. Without an entry or
+// with a timezone that cannot be read, the time is still returned, in UTC,
+// with ErrUnknownTimezone.
+func (connection *Connection) ServerTimeContext(ctx context.Context) (time.Time, *time.Location, error) {
+	connection.ensureAuth(ctx)
+
+	request, err := connection.LogsRequest(ctx, LogQuery{MaxResults: 1, SortField: "time", Dir: SortDescending})
+	if err != nil {
+		return time.Time{}, nil, err
+	}
+
+	response, err := connection.doRequest(request)
+	if err != nil {
+		return time.Time{}, nil, err
+	}
+
+	defer func(Body io.ReadCloser) {
+		_ = Body.Close()
+	}(response.Body)
+
+	now, err := http.ParseTime(response.Header.Get("Date"))
+	if err != nil {
+		return time.Time{}, nil, fmt.Errorf("qvrpro: NAS sent no usable Date header: %w", err)
+	}
+
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		return time.Time{}, nil, err
+	}
+
+	var qvrResponse LogsResponse
+	if err = json.Unmarshal(body, &qvrResponse); err != nil {
+		return time.Time{}, nil, err
+	}
+
+	if len(qvrResponse.Items) > 0 {
+		if location, ok := parseTimezone(qvrResponse.Items[0].Timezone); ok {
+			return now.In(location), location, nil
+		}
+	}
+
+	return now.UTC(), time.UTC, ErrUnknownTimezone
+}
+
+// RecordingEvent is a recorded segment of a channel, either an alarm or a
+// normal recording as told by RecordingType. Times are UTC milliseconds.
+type RecordingEvent struct {
+	Start         int64
+	End           int64
+	RecordingType int
+}
+
+func (connection *Connection) RecordingEvents(channelId string, start int64, end int64) ([]RecordingEvent, error) {
+	return connection.RecordingEventsContext(context.Background(), channelId, start, end)
+}
+
+// RecordingEventsContext lists the alarm and normal recording segments of a
+// channel between start and end (UTC ms), ordered by start. QVR Pro does not
+// publish a recording index, so each hour of the range is probed with a play
+// session per recording type, as ListRecordingFiles does, and a segment is a
+// run of recorded hours cut to the range. A range longer than a day fails
+// with ErrRangeTooLong.
+func (connection *Connection) RecordingEventsContext(ctx context.Context, channelId string, start int64, end int64) ([]RecordingEvent, error) {
+	events := make([]RecordingEvent, 0)
+
+	for _, recordingType := range []int{RecordingTypeOnlyAlarmFile, RecordingTypeNormalFile} {
+		intervals, err := connection.recordedIntervals(ctx, channelId, start, end, recordingType)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, interval := range intervals {
+			events = append(events, RecordingEvent{
+				Start:         interval.Start.UnixMilli(),
+				End:           interval.End.UnixMilli(),
+				RecordingType: recordingType,
+			})
+		}
+	}
+
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].Start < events[j].Start
+	})
+
+	return events, nil
+}
+
+func (connection *Connection) CameraSnapshot(channelId string, imageTs int) ([]byte, error) {
+	return connection.CameraSnapshotContext(context.Background(), channelId, imageTs)
+}
+
+// CameraSnapshotContext returns the JPEG image a channel recorded at imageTs
+// (UTC ms). The snapshot API takes no size or quality parameters, so the image
+// always comes at the camera's own resolution; scale it after fetching if a
+// thumbnail is needed.
+func (connection *Connection) CameraSnapshotContext(ctx context.Context, channelId string, imageTs int) ([]byte, error) {
+	var buffer bytes.Buffer
+
+	_, err := connection.CameraSnapshotToContext(ctx, &buffer, channelId, imageTs)
+	if err != nil {
+		return nil, err
+	}
+
+	return buffer.Bytes(), nil
+}
+
+// snapshotWorkers bounds how many snapshots SnapshotAll fetches at once.
+const snapshotWorkers = 4
+
+// SnapshotErrors maps the channels SnapshotAll could not fetch to the cause.
+type SnapshotErrors map[string]error
+
+func (snapshotErrors SnapshotErrors) Error() string {
+	channels := make([]string, 0, len(snapshotErrors))
+	for channelId := range snapshotErrors {
+		channels = append(channels, channelId)
+	}
+	sort.Strings(channels)
+
+	messages := make([]string, 0, len(channels))
+	for _, channelId := range channels {
+		messages = append(messages, fmt.Sprintf("%s: %s", channelId, snapshotErrors[channelId]))
+	}
+	return fmt.Sprintf("qvrpro: %d snapshots failed (%s)", len(channels), strings.Join(messages, "; "))
+}
+
+func (connection *Connection) SnapshotAll(channelIds []string, imageTs int) (map[string][]byte, error) {
+	return connection.SnapshotAllContext(context.Background(), channelIds, imageTs)
+}
+
+// SnapshotAllContext fetches the snapshot of every channel in channelIds,
+// snapshotWorkers at a time. The map holds every snapshot that succeeded; if
+// any failed the error is a SnapshotErrors naming them. Cancelling ctx aborts
+// the requests in flight, starts no more and returns ctx.Err() with whatever
+// snapshots arrived before.
+func (connection *Connection) SnapshotAllContext(ctx context.Context, channelIds []string, imageTs int) (map[string][]byte, error) {
+	connection.ensureAuth(ctx)
+
+	snapshots := make(map[string][]byte, len(channelIds))
+	snapshotErrors := make(SnapshotErrors)
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	work := make(chan string)
+
+	for i := 0; i < snapshotWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for channelId := range work {
+				snapshot, err := connection.CameraSnapshotContext(ctx, channelId, imageTs)
+
+				mu.Lock()
+				if err != nil {
+					snapshotErrors[channelId] = err
+				} else {
+					snapshots[channelId] = snapshot
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+feed:
+	for _, channelId := range channelIds {
+		select {
+		case work <- channelId:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(work)
+	wg.Wait()
+
+	if ctx.Err() != nil {
+		return snapshots, ctx.Err()
+	}
+
+	if len(snapshotErrors) > 0 {
+		return snapshots, snapshotErrors
+	}
+
+	return snapshots, nil
+}
+
+func (connection *Connection) CameraSnapshotTo(writer io.Writer, channelId string, imageTs int) (int64, error) {
+	return connection.CameraSnapshotToContext(context.Background(), writer, channelId, imageTs)
+}
+
+// CameraSnapshotToContext streams the snapshot image into writer and returns
+// the number of bytes written. When the camera has no image for imageTs it
+// fails with ErrNoSnapshot and writes nothing.
+func (connection *Connection) CameraSnapshotToContext(ctx context.Context, writer io.Writer, channelId string, imageTs int) (int64, error) {
+	written, _, err := connection.cameraSnapshotTo(ctx, writer, channelId, strconv.Itoa(imageTs))
+	return written, err
+}
+
+func (connection *Connection) CameraSnapshotWithResponse(channelId string, imageTs int) (*ResponseMeta, []byte, error) {
+	return connection.CameraSnapshotWithResponseContext(context.Background(), channelId, imageTs)
+}
+
+// CameraSnapshotWithResponseContext is CameraSnapshotContext that also returns
+// what the NAS answered besides the image.
+func (connection *Connection) CameraSnapshotWithResponseContext(ctx context.Context, channelId string, imageTs int) (*ResponseMeta, []byte, error) {
+	var buffer bytes.Buffer
+
+	_, meta, err := connection.cameraSnapshotTo(ctx, &buffer, channelId, strconv.Itoa(imageTs))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return meta, buffer.Bytes(), nil
+}
+
+func (connection *Connection) CameraSnapshotLatest(channelId string) ([]byte, error) {
+	return connection.CameraSnapshotLatestContext(context.Background(), channelId)
+}
+
+// CameraSnapshotLatestContext returns the camera's current image. It leaves
+// the image_ts parameter off, which the snapshot API answers with the live
+// frame. CameraSnapshot always sends image_ts, so it returns the frame
+// recorded at that time instead, and what a time of 0 yields is up to the
+// firmware.
+func (connection *Connection) CameraSnapshotLatestContext(ctx context.Context, channelId string) ([]byte, error) {
+	var buffer bytes.Buffer
+
+	_, _, err := connection.cameraSnapshotTo(ctx, &buffer, channelId, "")
+	if err != nil {
+		return nil, err
+	}
+
+	return buffer.Bytes(), nil
+}
+
+// CameraSnapshotRequest builds the request CameraSnapshot sends, signed with
+// the current session id, without sending it or logging in.
+func (connection *Connection) CameraSnapshotRequest(ctx context.Context, channelId string, imageTs int) (*http.Request, error) {
+	if err := validateChannelID(channelId); err != nil {
+		return nil, err
+	}
+
+	return connection.cameraSnapshotRequest(ctx, channelId, strconv.Itoa(imageTs))
+}
+
+// cameraSnapshotRequest sends imageTs as image_ts, the parameter the
+// snapshot API takes the time to fetch in, and leaves it off when empty.
+func (connection *Connection) cameraSnapshotRequest(ctx context.Context, channelId string, imageTs string) (*http.Request, error) {
+	params := url.Values{}
+	params.Add("sid", connection.Sid())
+	params.Add("ver", connection.apiVersion)
+	if len(imageTs) > 0 {
+		params.Add("image_ts", imageTs)
+	}
+
+	return connection.apiRequest(ctx, connection.CameraSnapshotPath(channelId), params)
+}
+
+// cameraSnapshotTo leaves the timestamp off when imageTs is empty.
+func (connection *Connection) cameraSnapshotTo(ctx context.Context, writer io.Writer, channelId string, imageTs string) (int64, *ResponseMeta, error) {
+	if err := validateChannelID(channelId); err != nil {
+		return 0, nil, err
+	}
+
+	connection.ensureAuth(ctx)
+
+	request, err := connection.cameraSnapshotRequest(ctx, channelId, imageTs)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	response, err := connection.doRequest(request)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	defer func(Body io.ReadCloser) {
+		_ = Body.Close()
+	}(response.Body)
+
+	reader := bufio.NewReader(response.Body)
+	if err := checkSnapshot(response, reader); err != nil {
+		return 0, nil, err
+	}
+
+	written, err := io.Copy(writer, reader)
+	return written, newResponseMeta(response), err
+}
+
+func (connection *Connection) CameraSnapshotInfo(channelId string, imageTs int) ([]byte, string, int64, error) {
+	return connection.CameraSnapshotInfoContext(context.Background(), channelId, imageTs)
+}
+
+// CameraSnapshotInfoContext is CameraSnapshotContext that also returns the
+// Content-Type of the image and the time (UTC ms) it was taken. That time
+// comes from the Last-Modified header, in whole seconds, when the NAS sends
+// one and is the requested imageTs otherwise.
+func (connection *Connection) CameraSnapshotInfoContext(ctx context.Context, channelId string, imageTs int) ([]byte, string, int64, error) {
+	var buffer bytes.Buffer
+
+	_, meta, err := connection.cameraSnapshotTo(ctx, &buffer, channelId, strconv.Itoa(imageTs))
+	if err != nil {
+		return nil, "", 0, err
+	}
+	header := meta.Header
+
+	actualTs := int64(imageTs)
+	if modified, err := http.ParseTime(header.Get("Last-Modified")); err == nil {
+		actualTs = modified.UnixMilli()
+	}
+
+	contentType := header.Get("Content-Type")
+	if len(contentType) == 0 {
+		contentType = http.DetectContentType(buffer.Bytes())
+	}
+
+	return buffer.Bytes(), contentType, actualTs, nil
+}
+
+func (connection *Connection) ExportRecording(channelId string, start int64, end int64, writer io.Writer) error {
+	return connection.ExportRecordingContext(context.Background(), channelId, start, end, writer)
+}
+
+// ExportRecordingContext writes the recording of a channel between start and
+// end (UTC ms) to writer as an MP4 file. Rather than stitching play session
+// frames together, it asks the recording file API, which assembles the file
+// on the NAS, for the first stream StreamList reports: 0 on a single-stream
+// camera, one of 1 to 3 on a multi-stream one. DownloadRecordingFile exports
+// another stream.
+func (connection *Connection) ExportRecordingContext(ctx context.Context, channelId string, start int64, end int64, writer io.Writer) error {
+	streams, err := connection.StreamListContext(ctx, channelId)
+	if err != nil {
+		return err
+	}
+	if len(streams) == 0 {
+		return fmt.Errorf("%w: channel %q lists no streams", ErrUnknownStream, channelId)
+	}
+
+	stream, err := strconv.Atoi(streams[0].ID)
+	if err != nil {
+		return fmt.Errorf("%w %q on channel %q", ErrUnknownStream, streams[0].ID, channelId)
+	}
+
+	return connection.recordingFile(ctx, channelId, stream, start, end, writer)
+}
+
+// RecordingFile is a piece of a channel's recording that DownloadRecordingFile
+// fetches as one MP4 file. Times are UTC milliseconds.
+type RecordingFile struct {
+	ChannelID string
+	Stream    int
+	Start     int64
+	End       int64
+}
 
-	baseUrl.RawQuery = params.Encode()
-	tr := &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-	}
-	client := &http.Client{Transport: tr}
+func (file RecordingFile) Duration() time.Duration {
+	return time.Duration(file.End-file.Start) * time.Millisecond
+}
 
-	log.Printf("[INFO] %s\n", baseUrl.String())
+func (connection *Connection) ListRecordingFiles(channelId string, start int64, end int64) ([]RecordingFile, error) {
+	return connection.ListRecordingFilesContext(context.Background(), channelId, start, end)
+}
 
-	response, err := client.Get(baseUrl.String())
+// ListRecordingFilesContext lists the recorded stretches of a channel between
+// start and end (UTC ms), one RecordingFile per run of recorded hours, cut to
+// the range; set Stream on them for another stream of a multi-stream camera.
+// QVR Pro stores no file index the API could list, so each hour of the range
+// is probed with a play session as RecordingTimeline does, and the files are
+// only as precise as those hours. To keep that to about 25 sessions a range
+// longer than a day fails with ErrRangeTooLong. The API does not report file
+// sizes; a file's size is only known once DownloadRecordingFile fetched it.
+func (connection *Connection) ListRecordingFilesContext(ctx context.Context, channelId string, start int64, end int64) ([]RecordingFile, error) {
+	intervals, err := connection.recordedIntervals(ctx, channelId, start, end, RecordingTypeAll)
 	if err != nil {
 		return nil, err
 	}
 
-	defer func(Body io.ReadCloser) {
-		_ = Body.Close()
-	}(response.Body)
-
-	body, err := io.ReadAll(response.Body)
-
-	if err != nil {
-		return nil, err
+	files := make([]RecordingFile, 0, len(intervals))
+	for _, interval := range intervals {
+		files = append(files, RecordingFile{ChannelID: channelId, Start: interval.Start.UnixMilli(), End: interval.End.UnixMilli()})
 	}
-	return body, nil
+
+	return files, nil
 }
 
-func (connection *Connection) CreateSessionId(channelId string, startTime int) (string, error) {
-	baseUrl, err := url.Parse(connection.url)
-	if err == nil {
-		baseUrl.Path = connection.PlayPath()
+var ErrRangeTooLong = errors.New("qvrpro: time range too long to probe for recordings")
 
-		params := url.Values{}
-		params.Add("cmd", "open")
-		params.Add("sid", connection.sid)
-		params.Add("ver", "v1")
+// maxProbeRange is the longest range recordedIntervals probes, which keeps a
+// call to about 25 play sessions.
+const maxProbeRange = 24 * time.Hour
 
-		params.Add("ch_sid", channelId)
-		params.Add("start_time", strconv.Itoa(startTime))
-		params.Add("query_type", "0")
-		params.Add("recording_type", "0")
-		params.Add("stream", "0")
-		params.Add("data_type", "0")
+// recordedIntervals probes each clock hour between start and end (UTC ms) for
+// recordings of recordingType and returns the recorded runs, cut to the range.
+func (connection *Connection) recordedIntervals(ctx context.Context, channelId string, start int64, end int64, recordingType int) ([]TimelineInterval, error) {
+	if err := validateChannelID(channelId); err != nil {
+		return nil, err
+	}
+	if end <= start {
+		return nil, fmt.Errorf("qvrpro: recording range ends at %d before it starts at %d", end, start)
+	}
 
-		baseUrl.RawQuery = params.Encode()
-		tr := &http.Transport{
-			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-		}
-		client := &http.Client{Transport: tr}
+	from, to := time.UnixMilli(start), time.UnixMilli(end)
+	if to.Sub(from) > maxProbeRange {
+		return nil, fmt.Errorf("%w: %s is longer than %s", ErrRangeTooLong, to.Sub(from), maxProbeRange)
+	}
 
-		log.Printf("[INFO] %s\n", baseUrl.String())
+	timeline := &Timeline{Start: from.Truncate(time.Hour), Slot: time.Hour}
+	for slot := timeline.Start; slot.Before(to); slot = slot.Add(timeline.Slot) {
+		recorded, err := connection.probeRecording(ctx, channelId, maxTime(slot, from), minTime(slot.Add(timeline.Slot), to), recordingType)
+		if err != nil {
+			return nil, err
+		}
 
-		response, err := client.Get(baseUrl.String())
+		timeline.Recorded = append(timeline.Recorded, recorded)
+	}
 
-		if nil == err {
-			defer func(Body io.ReadCloser) {
-				_ = Body.Close()
-			}(response.Body)
+	intervals := timeline.Intervals()
+	for i := range intervals {
+		intervals[i].Start = maxTime(intervals[i].Start, from)
+		intervals[i].End = minTime(intervals[i].End, to)
+	}
 
-			bodyText, err := io.ReadAll(response.Body)
-			if nil == err {
-				v := strings.Split(string(bodyText), "\n")
+	return intervals, nil
+}
 
-				code, _ := strconv.Atoi(v[1])
-				if code == 0 {
-					return v[2], nil
-				}
-				message, exists := errorCodes[code]
-				if exists {
-					log.Println(message)
-					err = errors.New(message)
-				}
-			} else {
-				log.Println(err.Error())
-			}
-		} else {
-			log.Println(err.Error())
-		}
+func minTime(a time.Time, b time.Time) time.Time {
+	if a.Before(b) {
+		return a
 	}
-	return "", err
+	return b
 }
 
-func (connection *Connection) PlaySeek(sessionId string, seekTime int) (bool, error) {
-	baseUrl, err := url.Parse(connection.url)
-	if err != nil {
-		log.Println("Malformed URL: ", err.Error())
-		return false, err
+func maxTime(a time.Time, b time.Time) time.Time {
+	if a.After(b) {
+		return a
 	}
+	return b
+}
 
-	baseUrl.Path = connection.PlayPath()
+func (connection *Connection) DownloadRecordingFile(file RecordingFile, writer io.Writer) error {
+	return connection.DownloadRecordingFileContext(context.Background(), file, writer)
+}
 
-	params := url.Values{}
-	params.Add("cmd", "seek")
-	params.Add("sid", connection.sid)
-	params.Add("ver", apiPlayVersion)
-	params.Add("session", sessionId)
-	params.Add("seek_time", strconv.Itoa(seekTime))
+// DownloadRecordingFileContext writes file to writer as an MP4 file.
+func (connection *Connection) DownloadRecordingFileContext(ctx context.Context, file RecordingFile, writer io.Writer) error {
+	return connection.recordingFile(ctx, file.ChannelID, file.Stream, file.Start, file.End, writer)
+}
 
-	baseUrl.RawQuery = params.Encode()
-	tr := &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+func (connection *Connection) recordingFile(ctx context.Context, channelId string, stream int, start int64, end int64, writer io.Writer) error {
+	if end <= start {
+		return fmt.Errorf("qvrpro: recording range ends at %d before it starts at %d", end, start)
 	}
-	client := &http.Client{Transport: tr}
 
-	log.Printf("[INFO] %s\n", baseUrl.String())
+	connection.ensureAuth(ctx)
 
-	response, err := client.Get(baseUrl.String())
+	request, err := connection.RecordingFileRequest(ctx, channelId, stream, start, end)
+	if err != nil {
+		return err
+	}
 
+	response, err := connection.doRequest(request)
 	if err != nil {
-		return false, err
+		return err
 	}
 
 	defer func(Body io.ReadCloser) {
 		_ = Body.Close()
 	}(response.Body)
 
-	bodyText, err := io.ReadAll(response.Body)
-
-	v := strings.Split(string(bodyText), "\n")
+	written, err := io.Copy(writer, response.Body)
 
-	code, _ := strconv.Atoi(v[1])
-	if code != 0 {
-		message, exists := errorCodes[code]
-		if exists {
-			return false, errors.New(message)
-		}
-	}
+	connection.logf("[INFO] Bytes written %d\n", written)
+	connection.observeBytes(connection.RecordingFilePath(channelId, stream), written)
 
-	return code == 0, nil
+	return err
 }
 
-func (connection *Connection) Play(sessionId string) (bool, error) {
-	baseUrl, err := url.Parse(connection.url)
-	if err != nil {
-		log.Println("Malformed URL: ", err.Error())
-		return false, err
+// RecordingFileRequest builds the request DownloadRecordingFile sends for
+// stream (0 for single-stream cameras, 1 to 3 for multi-stream ones), signed
+// with the current session id, without sending it or logging in.
+func (connection *Connection) RecordingFileRequest(ctx context.Context, channelId string, stream int, start int64, end int64) (*http.Request, error) {
+	if err := validateChannelID(channelId); err != nil {
+		return nil, err
 	}
 
-	baseUrl.Path = connection.PlayPath()
-
 	params := url.Values{}
-	params.Add("cmd", "play")
-	params.Add("sid", connection.sid)
-	params.Add("ver", apiPlayVersion)
-	params.Add("session", sessionId)
+	params.Add("sid", connection.Sid())
+	params.Add("ver", connection.apiVersion)
+	params.Add("start_time", strconv.FormatInt(start, 10))
+	params.Add("end_time", strconv.FormatInt(end, 10))
 
-	baseUrl.RawQuery = params.Encode()
+	return connection.apiRequest(ctx, connection.RecordingFilePath(channelId, stream), params)
+}
 
-	tr := &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-	}
-	client := &http.Client{Transport: tr}
+var ErrNoSnapshot = errors.New("qvrpro: no snapshot available")
 
-	log.Printf("[INFO] %s\n", baseUrl.String())
+// jpegMagic starts every JPEG file.
+var jpegMagic = []byte{0xFF, 0xD8, 0xFF}
 
-	response, err := client.Get(baseUrl.String())
+// checkSnapshot peeks at a snapshot response and returns ErrNoSnapshot unless
+// it holds a JPEG image, or the API error if the NAS answered with one.
+func checkSnapshot(response *http.Response, reader *bufio.Reader) error {
+	if response.StatusCode == http.StatusNoContent {
+		return ErrNoSnapshot
+	}
 
-	if err != nil {
-		return false, err
+	mediaType, _, _ := mime.ParseMediaType(response.Header.Get("Content-Type"))
+	if strings.HasSuffix(mediaType, "json") {
+		body, _ := io.ReadAll(io.LimitReader(reader, maxErrorBody))
+		if err := apiErrorBody(body); err != nil {
+			return err
+		}
+		return ErrNoSnapshot
 	}
 
-	defer func(Body io.ReadCloser) {
-		_ = Body.Close()
-	}(response.Body)
+	if len(mediaType) > 0 && !strings.HasPrefix(mediaType, "image/") && mediaType != "application/octet-stream" {
+		return fmt.Errorf("%w: content type %q", ErrNoSnapshot, mediaType)
+	}
 
-	bodyText, err := io.ReadAll(response.Body)
+	magic, _ := reader.Peek(len(jpegMagic))
+	if !bytes.Equal(magic, jpegMagic) {
+		return ErrNoSnapshot
+	}
 
-	v := strings.Split(string(bodyText), "\n")
+	return nil
+}
 
-	code, _ := strconv.Atoi(v[1])
-	if code != 0 {
-		message, exists := errorCodes[code]
-		if exists {
-			log.Println(message)
-			return false, errors.New(message)
-		}
-	}
+var ErrEventNotFound = errors.New("qvrpro: event not found")
 
-	return code == 0, nil
+func (connection *Connection) EventSnapshot(channelId string, eventId int) ([]byte, error) {
+	return connection.EventSnapshotContext(context.Background(), channelId, eventId)
 }
 
-//goland:noinspection GoUnusedConst
-const (
-	RecordingTypeOnlyAlarmFile = 1
-	RecordingTypeNormalFile    = 1
-	DataTypeJPeg               = 0
-	DataTypeSource             = 1
-)
+// eventSnapshotWindow is how far back EventSnapshot searches the event log.
+const eventSnapshotWindow = 7 * 24 * time.Hour
+
+// EventSnapshotContext returns the channel's snapshot at the moment the event
+// with eventId (LogEntry.EventID) fired. QVR Pro publishes no per-event
+// thumbnail, so the event is looked up in the channel's surveillance event
+// log of the last seven days, newest first, and its time passed to the
+// snapshot API as image_ts. Older events yield ErrEventNotFound; a caller
+// holding the LogEntry can pass its UTCTime to CameraSnapshot instead.
+func (connection *Connection) EventSnapshotContext(ctx context.Context, channelId string, eventId int) ([]byte, error) {
+	if err := validateChannelID(channelId); err != nil {
+		return nil, err
+	}
 
-// PlayGet
-// 1. If data_type (parameter in Step 1) is '0'/DataTypeJPeg (JPEG)
-// The frame is only a video frame
-// ---
-// [channel_name]\n
-// [timestamp]\n // in UTC time format
-// [jpeg image length]\n // INT
-// [jpeg data] // BINARY, binary data of length [jpeg image length]
-// ---
-// 2. If data_type (parameter in Step 1) is '1'/DataTypeSource (source format of recording files)
-// A [media frame] is either a video or an audio frame. The format of [media
-// frame] is the same as described in API "Live Streaming"
+	query := LogQuery{
+		LogType:          SurveillanceEventsLogType,
+		StartTime:        time.Now().Add(-eventSnapshotWindow).UnixMilli(),
+		GlobalChannelIDs: []string{channelId},
+		Dir:              SortDescending,
+	}
 
-func (connection *Connection) PlayGet(writer http.ResponseWriter, sessionId string, dataType int) error {
-	baseUrl, err := url.Parse(connection.url)
+	var event *LogEntry
+	err := connection.LogsIteratorContext(ctx, query, func(entry LogEntry) bool {
+		if entry.EventID == eventId {
+			event = &entry
+			return false
+		}
+		return true
+	})
 	if err != nil {
-		log.Println("Malformed URL: ", err.Error())
-		return err
+		return nil, err
 	}
 
-	baseUrl.Path = connection.PlayPath()
+	if event == nil {
+		return nil, fmt.Errorf("%w: %d on channel %q", ErrEventNotFound, eventId, channelId)
+	}
 
-	params := url.Values{}
-	params.Add("cmd", "get")
-	params.Add("sid", connection.sid)
-	params.Add("ver", apiPlayVersion)
-	params.Add("session", sessionId)
-	params.Add("data_type", strconv.Itoa(dataType))
+	return connection.CameraSnapshotContext(ctx, channelId, int(event.UTCTime))
+}
 
-	baseUrl.RawQuery = params.Encode()
-	tr := &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-	}
-	client := &http.Client{Transport: tr}
+// Schedule is the recording configuration of a channel. NormalRecording and
+// AlarmRecording reflect the schedule set up on the NAS and are true when any
+// stream has them enabled; QVR Pro offers no API to change them. Recording is
+// the live recording state, which SetRecordingSchedule switches with a manual
+// recording. Retention and other storage settings are neither readable nor
+// writable through the API, so they are not part of it.
+type Schedule struct {
+	NormalRecording bool
+	AlarmRecording  bool
+	Recording       bool
+}
+
+type ManualRecordingResponse struct {
+	Success   bool  `json:"success"`
+	ErrorCode int64 `json:"error_code"`
+}
+
+func (connection *Connection) RecordingSchedule(channelId string) (Schedule, error) {
+	return connection.RecordingScheduleContext(context.Background(), channelId)
+}
 
-	log.Printf("[INFO] %s\n", baseUrl.String())
+func (connection *Connection) RecordingScheduleContext(ctx context.Context, channelId string) (Schedule, error) {
+	var schedule Schedule
 
-	response, err := client.Get(baseUrl.String())
+	if err := validateChannelID(channelId); err != nil {
+		return schedule, err
+	}
 
+	cameras, err := connection.CameraListParsedContext(ctx)
 	if err != nil {
-		return err
+		return schedule, err
 	}
 
-	defer func(Body io.ReadCloser) {
-		_ = Body.Close()
-	}(response.Body)
+	for _, camera := range cameras {
+		if camera.GUID != channelId {
+			continue
+		}
 
-	// set the header as per original stream
-	for k, v := range response.Header {
-		writer.Header().Set(k, v[0])
+		for _, stream := range camera.StreamState {
+			schedule.NormalRecording = schedule.NormalRecording || stream.EnableNormalRecording != 0
+			schedule.AlarmRecording = schedule.AlarmRecording || stream.EnableAlarmRecording != 0
+		}
+		schedule.Recording = camera.Recording()
+
+		return schedule, nil
 	}
 
-	// stream the body to the client
-	written, err := io.Copy(writer, response.Body)
+	return schedule, fmt.Errorf("%w %q", ErrUnknownChannel, channelId)
+}
 
-	log.Printf("[INFO] Bytes written %d\n", written)
+var ErrScheduleReadOnly = errors.New("qvrpro: recording schedule cannot be changed through the API")
 
-	return err
+func (connection *Connection) SetRecordingSchedule(channelId string, schedule Schedule) error {
+	return connection.SetRecordingScheduleContext(context.Background(), channelId, schedule)
 }
 
-func (connection *Connection) PlayFrame(writer http.ResponseWriter, channelId string, seekTime int) error {
-
-	sessionId, err := connection.CreateSessionId(channelId, seekTime)
-	if len(sessionId) == 0 {
+// SetRecordingScheduleContext starts or stops manual recording to match
+// schedule.Recording. Asking for different NormalRecording or AlarmRecording
+// settings than the NAS has fails with ErrScheduleReadOnly before anything is
+// changed. Sessions without the needed permissions get a *QvrError.
+func (connection *Connection) SetRecordingScheduleContext(ctx context.Context, channelId string, schedule Schedule) error {
+	current, err := connection.RecordingScheduleContext(ctx, channelId)
+	if err != nil {
 		return err
 	}
 
-	success, err := connection.PlaySeek(sessionId, seekTime)
-	if !success {
-		return err
+	if current.NormalRecording != schedule.NormalRecording || current.AlarmRecording != schedule.AlarmRecording {
+		return ErrScheduleReadOnly
 	}
 
-	success, err = connection.Play(sessionId)
-	if !success {
-		return err
+	if current.Recording == schedule.Recording {
+		return nil
 	}
 
-	err = connection.PlayGet(writer, sessionId, DataTypeJPeg)
+	action := "stop"
+	if schedule.Recording {
+		action = "start"
+	}
 
-	return err
+	return connection.manualRecording(ctx, channelId, action)
 }
 
-func (connection *Connection) LiveStream(writer http.ResponseWriter, channelId string, streamId string) error {
-	baseUrl, err := url.Parse(connection.url)
+func (connection *Connection) manualRecording(ctx context.Context, channelId string, action string) error {
+	baseUrl, err := connection.resolve(connection.ManualRecordingPath(channelId, action))
 	if err != nil {
 		return err
 	}
 
-	baseUrl.Path = connection.StreamsPath()
-
 	params := url.Values{}
-	params.Add("sid", connection.sid)
-	params.Add("ch_sid", channelId)
-	params.Add("stream_id", streamId)
+	params.Add("sid", connection.Sid())
+	params.Add("ver", connection.apiVersion)
 
 	baseUrl.RawQuery = params.Encode()
-	tr := &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-	}
-	client := &http.Client{Transport: tr}
-
-	log.Printf("[INFO] %s\n", baseUrl.String())
-
-	response, err := client.Get(baseUrl.String())
-
+	response, err := connection.do(ctx, http.MethodPut, baseUrl)
 	if err != nil {
 		return err
 	}
@@ -647,100 +4328,122 @@ func (connection *Connection) LiveStream(writer http.ResponseWriter, channelId s
 		_ = Body.Close()
 	}(response.Body)
 
-	// set the header as per original stream
-	for k, v := range response.Header {
-		writer.Header().Set(k, v[0])
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		return err
 	}
 
-	// stream the body to the client
-	written, err := io.Copy(writer, response.Body)
+	var mrecResponse ManualRecordingResponse
+	err = json.Unmarshal(body, &mrecResponse)
+	if err != nil {
+		return err
+	}
 
-	log.Printf("[INFO] Bytes written %d\n", written)
+	if !mrecResponse.Success {
+		return newApiError(mrecResponse.ErrorCode, body)
+	}
 
-	return err
+	return nil
 }
 
-type LogEntry struct {
-	UTCTime         int64          `json:"UTC_time"`
-	UTCTimeS        string         `json:"UTC_time_s"`
-	Content         string         `json:"content"`
-	Level           int            `json:"level"`
-	LogID           int            `json:"log_id"`
-	LogType         int            `json:"log_type"`
-	NasIP           string         `json:"nas_ip"`
-	NasName         string         `json:"nas_name"`
-	ServerTime      int64          `json:"server_time"`
-	SourceIP        string         `json:"source_ip"`
-	SourceName      string         `json:"source_name"`
-	Time            string         `json:"time"`
-	Timezone        string         `json:"timezone"`
-	TimezoneOrder   int            `json:"timezone_order"`
-	User            string         `json:"user"`
-	Action          string         `json:"action,omitempty"`
-	Args            []string       `json:"args,omitempty"`
-	ChannelID       int            `json:"channel_id,omitempty"`
-	EventID         int            `json:"event_id,omitempty"`
-	GlobalChannelID string         `json:"global_channel_id,omitempty"`
-	MainType        int            `json:"main_type,omitempty"`
-	SubType         int            `json:"sub_type,omitempty"`
-	SubTypeOrder    int            `json:"sub_type_order,omitempty"`
-	Application     QvrApplication `json:"application,omitempty"`
+// ChannelPrivilege is what a user may do with one channel.
+type ChannelPrivilege struct {
+	View     bool
+	Playback bool
+	PTZ      bool
 }
 
-type LogsResponse struct {
-	Code          int        `json:"code"`
-	Items         []LogEntry `json:"items"`
-	Mesg          string     `json:"mesg"`
-	ResponseItems int        `json:"responseItems"`
-	TotalItems    int        `json:"totalItems"`
+// ChannelPrivileges maps channel GUIDs to the user's privileges on them.
+type ChannelPrivileges map[string]ChannelPrivilege
+
+var ErrPrivilegesUnavailable = errors.New("qvrpro: channel privileges are not available through the API")
+
+func (connection *Connection) UserPrivileges(user string) (ChannelPrivileges, error) {
+	return connection.UserPrivilegesContext(context.Background(), user)
 }
 
-//goland:noinspection GoUnusedConst
-const (
-	AllLogType                     = 0
-	SystemEventsLogType            = 1
-	SystemConnectionsLogType       = 2
-	SurveillanceEventsLogType      = 3
-	SurveillanceConnectionsLogType = 4
-	SurveillanceSettingsLogType    = 5
-)
+// UserPrivilegesContext returns the channel privileges of user. QVR Pro
+// publishes no access-control API, so they can only be derived for the logged
+// in user when that user is an administrator, who may view, play back and,
+// where the camera supports it, steer every channel. Any other user yields
+// ErrPrivilegesUnavailable rather than a guess.
+func (connection *Connection) UserPrivilegesContext(ctx context.Context, user string) (ChannelPrivileges, error) {
+	connection.ensureAuth(ctx)
 
-func (connection *Connection) Logs(logType uint, startTime int64, maxResults int) []LogEntry {
-	qvrProLogEntry := make([]LogEntry, 0)
+	if current, _ := connection.credentials(); user != current || !connection.IsAdmin() {
+		return nil, ErrPrivilegesUnavailable
+	}
 
-	baseUrl, err := url.Parse(connection.url)
+	capability, err := connection.CameraCapabilityParsedContext(ctx)
 	if err != nil {
-		// return errorResponse(http.StatusBadRequest, err.Error()), http.StatusBadRequest
-		return qvrProLogEntry
+		return nil, err
 	}
 
-	baseUrl.Path = connection.LogsPath()
+	privileges := make(ChannelPrivileges, len(capability.Channels))
+	for guid, channel := range capability.Channels {
+		privileges[guid] = ChannelPrivilege{View: true, Playback: true, PTZ: channel.PTZ}
+	}
 
-	params := url.Values{}
-	params.Add("sid", connection.sid)
-	if AllLogType != logType {
-		params.Add("log_type", strconv.Itoa(int(logType)))
+	return privileges, nil
+}
+
+var ErrPTZNotSupported = errors.New("qvrpro: channel does not support PTZ")
+var ErrPresetUnavailable = errors.New("qvrpro: PTZ preset points cannot be recalled through the API")
+
+type PTZResponse struct {
+	ErrorCode    string `json:"error_code"`
+	ErrorMessage string `json:"error_message"`
+}
+
+// ptzChannel looks the channel up in the cameraControl section of the camera
+// capability, which lists the channels that accept PTZ commands.
+func (connection *Connection) ptzChannel(ctx context.Context, channelId string) (*CameraControlChannel, error) {
+	if err := validateChannelID(channelId); err != nil {
+		return nil, err
 	}
-	if startTime != 0 {
-		params.Add("start_time", strconv.Itoa(int(startTime)))
 
+	body, err := connection.CameraCapabilityContext(ctx)
+	if err != nil {
+		return nil, err
 	}
-	params.Add("sort_field", "time")
-	params.Add("max_results", strconv.Itoa(maxResults))
-	params.Add("dir", "ASC")
 
-	baseUrl.RawQuery = params.Encode()
-	tr := &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	var capability CameraCapabilityResponse
+	err = json.Unmarshal(body, &capability)
+	if err != nil {
+		return nil, err
+	}
+
+	if !capability.Success {
+		return nil, newApiError(capability.ErrorCode, body)
+	}
+
+	for _, cameraControl := range capability.CameraControl {
+		for i := range cameraControl.GUIDs {
+			if cameraControl.GUIDs[i].GUID == channelId {
+				return &cameraControl.GUIDs[i], nil
+			}
+		}
 	}
-	client := &http.Client{Transport: tr}
 
-	log.Printf("[INFO] %s\n", baseUrl.String())
+	return nil, ErrPTZNotSupported
+}
+
+func (connection *Connection) ptzInvoke(ctx context.Context, channelId string, actionId string, extra url.Values) error {
+	baseUrl, err := connection.resolve(connection.PTZActionPath(channelId, actionId))
+	if err != nil {
+		return err
+	}
 
-	response, err := client.Get(baseUrl.String())
+	params := url.Values{}
+	params.Add("sid", connection.Sid())
+	for key, values := range extra {
+		params[key] = values
+	}
 
+	baseUrl.RawQuery = params.Encode()
+	response, err := connection.do(ctx, http.MethodPut, baseUrl)
 	if err != nil {
-		return qvrProLogEntry
+		return err
 	}
 
 	defer func(Body io.ReadCloser) {
@@ -748,50 +4451,83 @@ func (connection *Connection) Logs(logType uint, startTime int64, maxResults int
 	}(response.Body)
 
 	body, err := io.ReadAll(response.Body)
-	var qvrResponse LogsResponse
-	err = json.Unmarshal(body, &qvrResponse)
 	if err != nil {
-		return qvrProLogEntry
+		return err
 	}
 
-	for i := range qvrResponse.Items {
-		qvrResponse.Items[i].Application = connection.qvrApp
+	var ptzResponse PTZResponse
+	err = json.Unmarshal(body, &ptzResponse)
+	if err != nil {
+		return err
+	}
+
+	// 0x96020000 is documented as success as well
+	code := convertHexToInt(ptzResponse.ErrorCode)
+	if code != 0 && code != convertHexToInt("0x96020000") {
+		return newQvrError(code, ptzResponse.ErrorMessage)
 	}
 
-	return qvrResponse.Items
+	return nil
 }
 
-func (connection *Connection) CameraSnapshot(channelId string, imageTs int) ([]byte, error) {
-	baseUrl, err := url.Parse(connection.url)
-	if err != nil {
-		return nil, err
+func ptzDirection(pan int, tilt int) string {
+	var direction []string
+	if tilt > 0 {
+		direction = append(direction, "up")
+	} else if tilt < 0 {
+		direction = append(direction, "down")
 	}
+	if pan < 0 {
+		direction = append(direction, "left")
+	} else if pan > 0 {
+		direction = append(direction, "right")
+	}
+	return strings.Join(direction, "_")
+}
 
-	baseUrl.Path = connection.CameraSnapshotPath(channelId)
+func (connection *Connection) PTZMove(channelId string, pan int, tilt int, zoom int) error {
+	return connection.PTZMoveContext(context.Background(), channelId, pan, tilt, zoom)
+}
 
-	params := url.Values{}
-	params.Add("sid", connection.sid)
-	params.Add("ver", apiVersion)
-	params.Add("ts", strconv.Itoa(imageTs))
+// PTZMoveContext steps the camera once in the direction given by the signs of
+// pan (negative is left), tilt (negative is down) and zoom (negative is out).
+// The API has no notion of distance so the magnitudes are ignored.
+func (connection *Connection) PTZMoveContext(ctx context.Context, channelId string, pan int, tilt int, zoom int) error {
+	connection.ensureAuth(ctx)
 
-	baseUrl.RawQuery = params.Encode()
-	tr := &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	_, err := connection.ptzChannel(ctx, channelId)
+	if err != nil {
+		return err
 	}
-	client := &http.Client{Transport: tr}
 
-	log.Printf("[INFO] %s\n", baseUrl.String())
+	if direction := ptzDirection(pan, tilt); len(direction) > 0 {
+		err = connection.ptzInvoke(ctx, channelId, direction, nil)
+		if err != nil {
+			return err
+		}
+	}
 
-	response, err := client.Get(baseUrl.String())
-	if err != nil {
-		return nil, err
+	if zoom > 0 {
+		return connection.ptzInvoke(ctx, channelId, "zoom_in", nil)
+	} else if zoom < 0 {
+		return connection.ptzInvoke(ctx, channelId, "zoom_out", nil)
 	}
 
-	defer func(Body io.ReadCloser) {
-		_ = Body.Close()
-	}(response.Body)
+	return nil
+}
 
-	body, _ := io.ReadAll(response.Body)
+func (connection *Connection) PTZGotoPreset(channelId string, presetId int) error {
+	return connection.PTZGotoPresetContext(context.Background(), channelId, presetId)
+}
+
+// PTZGotoPresetContext would move the camera to one of its preset points.
+// The action_list of the published API has no preset action, and camera
+// capability only reports whether a camera has preset points, so it always
+// fails with ErrPresetUnavailable rather than sending a guessed command.
+func (connection *Connection) PTZGotoPresetContext(ctx context.Context, channelId string, presetId int) error {
+	if err := validateChannelID(channelId); err != nil {
+		return err
+	}
 
-	return body, nil
+	return ErrPresetUnavailable
 }
@@ -0,0 +1,814 @@
+package qvrpro
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// roundTripFunc answers requests without a network, for WithTransport.
+type roundTripFunc func(request *http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(request *http.Request) (*http.Response, error) {
+	return f(request)
+}
+
+// cannedTransport answers every request with status, contentType and body.
+func cannedTransport(status int, contentType string, body string) http.RoundTripper {
+	return roundTripFunc(func(request *http.Request) (*http.Response, error) {
+		return &http.Response{
+			StatusCode: status,
+			Header:     http.Header{"Content-Type": []string{contentType}},
+			Body:       io.NopCloser(strings.NewReader(body)),
+			Request:    request,
+		}, nil
+	})
+}
+
+func TestLogin(t *testing.T) {
+	tests := []struct {
+		name        string
+		status      int
+		contentType string
+		body        string
+		wantErr     error
+		wantStatus  int
+		wantSid     string
+	}{
+		{
+			name:        "xml",
+			status:      http.StatusOK,
+			contentType: "text/xml",
+			body:        `<QDocRoot><authPassed>1</authPassed><authSid>xmlsid</authSid><isAdmin>1</isAdmin></QDocRoot>`,
+			wantSid:     "xmlsid",
+		},
+		{
+			name:        "json",
+			status:      http.StatusOK,
+			contentType: "application/json",
+			body:        `{"authPassed":1,"authSid":"jsonsid","isAdmin":1}`,
+			wantSid:     "jsonsid",
+		},
+		{
+			name:        "rejected",
+			status:      http.StatusOK,
+			contentType: "text/xml",
+			body:        `<QDocRoot><authPassed>0</authPassed></QDocRoot>`,
+			wantErr:     ErrAuthFailed,
+		},
+		{
+			name:        "booting",
+			status:      http.StatusOK,
+			contentType: "application/json",
+			body:        `{"authPassed":0,"is_booting":"1"}`,
+			wantErr:     ErrBooting,
+		},
+		{
+			name:        "unauthorized",
+			status:      http.StatusUnauthorized,
+			contentType: "text/html",
+			body:        `<html>401</html>`,
+			wantStatus:  http.StatusUnauthorized,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			connection := NewConnection("http://nas", WithTransport(cannedTransport(test.status, test.contentType, test.body)))
+
+			ok, err := connection.Login("admin", "secret")
+
+			var statusError *StatusError
+			switch {
+			case test.wantStatus != 0:
+				if !errors.As(err, &statusError) || statusError.StatusCode != test.wantStatus {
+					t.Fatalf("Login error = %v, want status %d", err, test.wantStatus)
+				}
+			case !errors.Is(err, test.wantErr):
+				t.Fatalf("Login error = %v, want %v", err, test.wantErr)
+			}
+			if ok != (err == nil) {
+				t.Errorf("Login = %v with error %v", ok, err)
+			}
+			if sid := connection.Sid(); sid != test.wantSid {
+				t.Errorf("Sid = %q, want %q", sid, test.wantSid)
+			}
+			if err == nil && !connection.IsAdmin() {
+				t.Error("IsAdmin = false, want true")
+			}
+		})
+	}
+}
+
+func TestLoginRejectedStopsRenewal(t *testing.T) {
+	logins := 0
+	authPassed := 1
+	transport := roundTripFunc(func(request *http.Request) (*http.Response, error) {
+		if strings.HasSuffix(request.URL.Path, "/authLogin.cgi") {
+			logins++
+			body := fmt.Sprintf(`<QDocRoot><authPassed>%d</authPassed><authSid>sid</authSid></QDocRoot>`, authPassed)
+			return cannedTransport(http.StatusOK, "text/xml", body).RoundTrip(request)
+		}
+		return cannedTransport(http.StatusOK, "application/json", `{"success":true,"data":[]}`).RoundTrip(request)
+	})
+	connection := NewConnection("http://nas", WithTransport(transport))
+
+	if _, err := connection.Login("admin", "secret"); err != nil {
+		t.Fatalf("Login: %v", err)
+	}
+
+	// the password is changed on the NAS and the session expires
+	authPassed = 0
+	connection.clearSession()
+
+	for i := 0; i < 3; i++ {
+		_, _ = connection.CameraListParsed()
+	}
+	if logins != 2 {
+		t.Errorf("authLogin.cgi called %d times, want 2: a rejected password must not be retried", logins)
+	}
+	if user, password := connection.credentials(); user != "" || password != "" {
+		t.Errorf("credentials = %q, %q after ErrAuthFailed, want them cleared", user, password)
+	}
+}
+
+func TestLoginCachedCopy(t *testing.T) {
+	body := `<QDocRoot><authPassed>1</authPassed><authSid>sid</authSid><isAdmin>1</isAdmin></QDocRoot>`
+	connection := NewConnection("http://nas", WithTransport(cannedTransport(http.StatusOK, "text/xml", body)))
+
+	if _, err := connection.LoginDetailed("admin", "secret"); err != nil {
+		t.Fatalf("LoginDetailed: %v", err)
+	}
+
+	cached, err := connection.LoginDetailed("admin", "secret")
+	if err != nil {
+		t.Fatalf("LoginDetailed again: %v", err)
+	}
+	cached.IsAdmin = 0
+
+	if !connection.IsAdmin() {
+		t.Error("changing the cached login response changed the connection's")
+	}
+}
+
+func TestLogs(t *testing.T) {
+	tests := []struct {
+		name        string
+		body        string
+		wantContent []string
+		wantErr     bool
+	}{
+		{
+			name:        "entries",
+			body:        `{"code":0,"items":[{"content":"motion","level":1,"log_type":3},{"content":"login","log_type":2}],"responseItems":2,"totalItems":5}`,
+			wantContent: []string{"motion", "login"},
+		},
+		{
+			name: "empty",
+			body: `{"code":0,"items":[],"responseItems":0,"totalItems":0}`,
+		},
+		{
+			name:    "malformed",
+			body:    `<html>`,
+			wantErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			connection := NewConnection("http://nas", WithTransport(cannedTransport(http.StatusOK, "application/json", test.body)))
+
+			entries, err := connection.Logs(AllLogType, 0, 10)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("Logs error = %v, want error %v", err, test.wantErr)
+			}
+			if len(entries) != len(test.wantContent) {
+				t.Fatalf("Logs returned %d entries, want %d", len(entries), len(test.wantContent))
+			}
+			for i, entry := range entries {
+				if entry.Content != test.wantContent[i] {
+					t.Errorf("entry %d content = %q, want %q", i, entry.Content, test.wantContent[i])
+				}
+				if entry.Application != QvrPro {
+					t.Errorf("entry %d application = %q, want %q", i, entry.Application, QvrPro)
+				}
+			}
+		})
+	}
+}
+
+func TestCameraListParsed(t *testing.T) {
+	tests := []struct {
+		name      string
+		status    int
+		body      string
+		wantGUIDs []string
+		wantCode  uint32
+		wantHTTP  int
+	}{
+		{
+			name:      "cameras",
+			status:    http.StatusOK,
+			body:      `{"success":true,"data":[{"guid":"CH1","name":"Gate","status":"NVR_CAM_CONNECTED"},{"guid":"CH2","name":"Yard"}],"total_channel_num":2}`,
+			wantGUIDs: []string{"CH1", "CH2"},
+		},
+		{
+			name:     "api error",
+			status:   http.StatusOK,
+			body:     `{"success":false,"error_code":2969567234}`,
+			wantCode: 0xB1000002,
+		},
+		{
+			name:     "forbidden",
+			status:   http.StatusForbidden,
+			body:     `{"success":false,"error_code":2969567233}`,
+			wantCode: 0xB1000001,
+			wantHTTP: http.StatusForbidden,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			connection := NewConnection("http://nas", WithTransport(cannedTransport(test.status, "application/json", test.body)))
+
+			cameras, err := connection.CameraListParsed()
+
+			var statusError *StatusError
+			if errors.As(err, &statusError) != (test.wantHTTP != 0) {
+				t.Fatalf("CameraListParsed error = %v, want a StatusError: %v", err, test.wantHTTP != 0)
+			}
+			if statusError != nil && statusError.StatusCode != test.wantHTTP {
+				t.Errorf("StatusCode = %d, want %d", statusError.StatusCode, test.wantHTTP)
+			}
+
+			var qvrError *QvrError
+			if errors.As(err, &qvrError) != (test.wantCode != 0) {
+				t.Fatalf("CameraListParsed error = %v, want a QvrError: %v", err, test.wantCode != 0)
+			}
+			if qvrError != nil && qvrError.Code != test.wantCode {
+				t.Errorf("Code = 0x%08X, want 0x%08X", qvrError.Code, test.wantCode)
+			}
+
+			if len(cameras) != len(test.wantGUIDs) {
+				t.Fatalf("CameraListParsed returned %d cameras, want %d", len(cameras), len(test.wantGUIDs))
+			}
+			for i, camera := range cameras {
+				if camera.GUID != test.wantGUIDs[i] {
+					t.Errorf("camera %d GUID = %q, want %q", i, camera.GUID, test.wantGUIDs[i])
+				}
+			}
+		})
+	}
+}
+
+func TestPlayGetFrame(t *testing.T) {
+	tests := []struct {
+		name     string
+		body     string
+		wantJPEG string
+		wantCode uint32
+	}{
+		{
+			name:     "frame",
+			body:     "0\nGate\n1700000000000\n4\njpeg",
+			wantJPEG: "jpeg",
+		},
+		{
+			name:     "leading blank line",
+			body:     "\n0\nGate\n1700000000000\n4\njpeg",
+			wantJPEG: "jpeg",
+		},
+		{
+			name:     "failed",
+			body:     "-1828651006\n",
+			wantCode: 0x93010002,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			connection := NewConnection("http://nas", WithTransport(cannedTransport(http.StatusOK, "application/octet-stream", test.body)))
+
+			frame, err := connection.PlayGetFrame("session")
+
+			var qvrError *QvrError
+			if errors.As(err, &qvrError) != (test.wantCode != 0) {
+				t.Fatalf("PlayGetFrame error = %v, want a QvrError: %v", err, test.wantCode != 0)
+			}
+			if qvrError != nil {
+				if qvrError.Code != test.wantCode {
+					t.Errorf("Code = 0x%08X, want 0x%08X", qvrError.Code, test.wantCode)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("PlayGetFrame: %v", err)
+			}
+
+			if frame.ChannelName != "Gate" || frame.Timestamp.UnixMilli() != 1700000000000 || string(frame.JPEG) != test.wantJPEG {
+				t.Errorf("PlayGetFrame = %q %v %q, want \"Gate\" 1700000000000 %q", frame.ChannelName, frame.Timestamp.UnixMilli(), frame.JPEG, test.wantJPEG)
+			}
+		})
+	}
+}
+
+func TestPlayGetMedia(t *testing.T) {
+	var header [mediaHeaderSize]byte
+	copy(header[0:4], "q264")
+	header[4] = 1
+	copy(header[24:48], "Gate")
+	header[52] = 3
+	frame := string(header[:]) + "abc"
+
+	tests := []struct {
+		name     string
+		body     string
+		wantCode uint32
+	}{
+		{name: "frames", body: "0\n" + frame},
+		{name: "failed", body: "-1828651006\n", wantCode: 0x93010002},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			connection := NewConnection("http://nas", WithTransport(cannedTransport(http.StatusOK, "application/octet-stream", test.body)))
+
+			media, err := connection.PlayGetMedia("session")
+
+			var qvrError *QvrError
+			if errors.As(err, &qvrError) != (test.wantCode != 0) {
+				t.Fatalf("PlayGetMedia error = %v, want a QvrError: %v", err, test.wantCode != 0)
+			}
+			if qvrError != nil {
+				if qvrError.Code != test.wantCode {
+					t.Errorf("Code = 0x%08X, want 0x%08X", qvrError.Code, test.wantCode)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("PlayGetMedia: %v", err)
+			}
+			defer func() { _ = media.Close() }()
+
+			got, err := media.ReadFrame()
+			if err != nil {
+				t.Fatalf("ReadFrame: %v", err)
+			}
+			if got.FourCC != "q264" || !got.KeyFrame || got.ChannelName != "Gate" || string(got.Data) != "abc" {
+				t.Errorf("ReadFrame = %+v, want a q264 key frame of Gate with data \"abc\"", got)
+			}
+
+			if _, err := media.ReadFrame(); err != io.EOF {
+				t.Errorf("ReadFrame at end = %v, want io.EOF", err)
+			}
+		})
+	}
+}
+
+func TestCreateSessionIdStream(t *testing.T) {
+	var query url.Values
+	transport := roundTripFunc(func(request *http.Request) (*http.Response, error) {
+		query = request.URL.Query()
+		return cannedTransport(http.StatusOK, "text/plain", "\n0\nsession\n").RoundTrip(request)
+	})
+	connection := NewConnection("http://nas", WithTransport(transport))
+
+	session, err := connection.CreateSessionIdWithOptions("CH1", 0, SessionOptions{Stream: 2})
+	if err != nil {
+		t.Fatalf("CreateSessionIdWithOptions: %v", err)
+	}
+	if session != "session" {
+		t.Errorf("session = %q, want \"session\"", session)
+	}
+	if got := query.Get("stream_id"); got != "2" {
+		t.Errorf("stream_id = %q, want \"2\"", got)
+	}
+	if query.Has("stream") {
+		t.Errorf("query sends stream=%q, which qplay.cgi does not know", query.Get("stream"))
+	}
+}
+
+func TestListRecordingFiles(t *testing.T) {
+	recorded := map[int]bool{1: true, 2: true, 4: true}
+	transport := roundTripFunc(func(request *http.Request) (*http.Response, error) {
+		query := request.URL.Query()
+		body := "\n0\n"
+		if query.Get("cmd") == "open" {
+			startTime, _ := strconv.ParseInt(query.Get("start_time"), 10, 64)
+			if recorded[time.UnixMilli(startTime).UTC().Hour()] {
+				body = "\n0\nsession\n"
+			} else {
+				body = "\n-1828650492\n"
+			}
+		}
+		return cannedTransport(http.StatusOK, "text/plain", body).RoundTrip(request)
+	})
+	connection := NewConnection("http://nas", WithTransport(transport))
+
+	day := time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)
+	at := func(hour int, minute int) int64 {
+		return day.Add(time.Duration(hour)*time.Hour + time.Duration(minute)*time.Minute).UnixMilli()
+	}
+
+	files, err := connection.ListRecordingFiles("CH1", at(1, 30), at(5, 0))
+	if err != nil {
+		t.Fatalf("ListRecordingFiles: %v", err)
+	}
+
+	want := []RecordingFile{
+		{ChannelID: "CH1", Start: at(1, 30), End: at(3, 0)},
+		{ChannelID: "CH1", Start: at(4, 0), End: at(5, 0)},
+	}
+	if len(files) != len(want) {
+		t.Fatalf("ListRecordingFiles = %+v, want %+v", files, want)
+	}
+	for i := range want {
+		if files[i] != want[i] {
+			t.Errorf("file %d = %+v, want %+v", i, files[i], want[i])
+		}
+	}
+
+	if _, err := connection.ListRecordingFiles("CH1", at(0, 0), at(48, 0)); !errors.Is(err, ErrRangeTooLong) {
+		t.Errorf("ListRecordingFiles over two days = %v, want ErrRangeTooLong", err)
+	}
+}
+
+func TestDetectApplication(t *testing.T) {
+	tests := []struct {
+		name    string
+		answers map[string]string
+		want    QvrApplication
+	}{
+		{
+			name:    "elite behind a login page",
+			answers: map[string]string{"/qvrpro/camera/list": `<html>login</html>`, "/qvrelite/camera/list": `{"success":true,"data":[]}`},
+			want:    QvrElite,
+		},
+		{
+			name:    "pro",
+			answers: map[string]string{"/qvrpro/camera/list": `{"success":true,"data":[]}`},
+			want:    QvrPro,
+		},
+		{
+			name:    "none",
+			answers: map[string]string{"/qvrpro/camera/list": `<html>login</html>`, "/qvrelite/camera/list": `{"success":false,"error_code":2969567233}`},
+			want:    QvrUnknown,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			transport := roundTripFunc(func(request *http.Request) (*http.Response, error) {
+				body, ok := test.answers[request.URL.Path]
+				if !ok {
+					return cannedTransport(http.StatusNotFound, "text/html", "").RoundTrip(request)
+				}
+				return cannedTransport(http.StatusOK, "text/html", body).RoundTrip(request)
+			})
+			connection := NewConnection("http://nas", WithTransport(transport))
+
+			app, err := connection.DetectApplication()
+			if app != test.want || (err == nil) != (test.want != QvrUnknown) {
+				t.Fatalf("DetectApplication = %v, %v, want %v", app, err, test.want)
+			}
+			if test.want != QvrUnknown && connection.Application() != test.want {
+				t.Errorf("Application = %v, want %v", connection.Application(), test.want)
+			}
+		})
+	}
+}
+
+func TestPlaySpeed(t *testing.T) {
+	tests := []struct {
+		speed       int
+		wantCommand string
+		wantSpeed   string
+	}{
+		{speed: 20, wantCommand: "ff", wantSpeed: "20"},
+		{speed: -160, wantCommand: "rew", wantSpeed: "160"},
+	}
+
+	for _, test := range tests {
+		t.Run(strconv.Itoa(test.speed), func(t *testing.T) {
+			var queries []url.Values
+			transport := roundTripFunc(func(request *http.Request) (*http.Response, error) {
+				queries = append(queries, request.URL.Query())
+				return cannedTransport(http.StatusOK, "text/plain", "\n0\n").RoundTrip(request)
+			})
+			connection := NewConnection("http://nas", WithTransport(transport))
+
+			if err := connection.PlaySpeed("session", test.speed); err != nil {
+				t.Fatalf("PlaySpeed: %v", err)
+			}
+			if len(queries) != 1 {
+				t.Fatalf("PlaySpeed sent %d requests, want 1", len(queries))
+			}
+			if got := queries[0].Get("cmd"); got != test.wantCommand {
+				t.Errorf("cmd = %q, want %q", got, test.wantCommand)
+			}
+			if got := queries[0].Get("speed"); got != test.wantSpeed {
+				t.Errorf("speed = %q, want %q", got, test.wantSpeed)
+			}
+		})
+	}
+}
+
+func TestCameraSnapshotRequest(t *testing.T) {
+	connection := NewConnection("http://nas")
+
+	request, err := connection.CameraSnapshotRequest(context.Background(), "CH1", 1700000000)
+	if err != nil {
+		t.Fatalf("CameraSnapshotRequest: %v", err)
+	}
+	query := request.URL.Query()
+	if got := query.Get("image_ts"); got != "1700000000" {
+		t.Errorf("image_ts = %q, want \"1700000000\"", got)
+	}
+	if query.Has("ts") {
+		t.Errorf("request sends ts=%q, which the snapshot API does not read", query.Get("ts"))
+	}
+
+	latest, err := connection.cameraSnapshotRequest(context.Background(), "CH1", "")
+	if err != nil {
+		t.Fatalf("cameraSnapshotRequest: %v", err)
+	}
+	if latest.URL.Query().Has("image_ts") {
+		t.Error("latest snapshot request sends image_ts")
+	}
+}
+
+func TestEventSnapshot(t *testing.T) {
+	var logQuery, snapshotQuery url.Values
+	transport := roundTripFunc(func(request *http.Request) (*http.Response, error) {
+		if strings.HasSuffix(request.URL.Path, "/logs/logs") {
+			logQuery = request.URL.Query()
+			body := `{"code":0,"items":[{"event_id":7,"UTC_time":1700000000000},{"event_id":6,"UTC_time":1690000000000}],"responseItems":2,"totalItems":2}`
+			return cannedTransport(http.StatusOK, "application/json", body).RoundTrip(request)
+		}
+		snapshotQuery = request.URL.Query()
+		return cannedTransport(http.StatusOK, "image/jpeg", "\xFF\xD8\xFFjpeg").RoundTrip(request)
+	})
+	connection := NewConnection("http://nas", WithTransport(transport))
+
+	if _, err := connection.EventSnapshot("CH1", 6); err != nil {
+		t.Fatalf("EventSnapshot: %v", err)
+	}
+
+	if got := snapshotQuery.Get("image_ts"); got != "1690000000000" {
+		t.Errorf("image_ts = %q, want the event time 1690000000000", got)
+	}
+	if got := logQuery.Get("dir"); got != SortDescending {
+		t.Errorf("dir = %q, want %q", got, SortDescending)
+	}
+	if len(logQuery.Get("start_time")) == 0 {
+		t.Error("event log searched without a start_time bound")
+	}
+}
+
+func TestRecordingEvents(t *testing.T) {
+	// hours with recordings per recording_type
+	recorded := map[string]map[int]bool{
+		"1": {2: true},
+		"2": {0: true, 1: true, 3: true},
+	}
+	transport := roundTripFunc(func(request *http.Request) (*http.Response, error) {
+		query := request.URL.Query()
+		body := "\n0\n"
+		if query.Get("cmd") == "open" {
+			startTime, _ := strconv.ParseInt(query.Get("start_time"), 10, 64)
+			if recorded[query.Get("recording_type")][time.UnixMilli(startTime).UTC().Hour()] {
+				body = "\n0\nsession\n"
+			} else {
+				body = "\n-1828650492\n"
+			}
+		}
+		return cannedTransport(http.StatusOK, "text/plain", body).RoundTrip(request)
+	})
+	connection := NewConnection("http://nas", WithTransport(transport))
+
+	day := time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)
+	at := func(hour int) int64 {
+		return day.Add(time.Duration(hour) * time.Hour).UnixMilli()
+	}
+
+	events, err := connection.RecordingEvents("CH1", at(0), at(4))
+	if err != nil {
+		t.Fatalf("RecordingEvents: %v", err)
+	}
+
+	want := []RecordingEvent{
+		{Start: at(0), End: at(2), RecordingType: RecordingTypeNormalFile},
+		{Start: at(2), End: at(3), RecordingType: RecordingTypeOnlyAlarmFile},
+		{Start: at(3), End: at(4), RecordingType: RecordingTypeNormalFile},
+	}
+	if len(events) != len(want) {
+		t.Fatalf("RecordingEvents = %+v, want %+v", events, want)
+	}
+	for i := range want {
+		if events[i] != want[i] {
+			t.Errorf("event %d = %+v, want %+v", i, events[i], want[i])
+		}
+	}
+}
+
+func TestRecordingTimelineSessionFull(t *testing.T) {
+	opens := 0
+	transport := roundTripFunc(func(request *http.Request) (*http.Response, error) {
+		body := "\n0\n"
+		if request.URL.Query().Get("cmd") == "open" {
+			opens++
+			switch {
+			case opens == 2:
+				// 0x93010007: all play sessions in use, freed by the retry
+				body = "\n-1828651001\n"
+			case opens == 6:
+				body = "\n-1828651006\n"
+			default:
+				body = "\n0\nsession\n"
+			}
+		}
+		return cannedTransport(http.StatusOK, "text/plain", body).RoundTrip(request)
+	})
+	connection := NewConnection("http://nas", WithTransport(transport))
+
+	timeline, err := connection.RecordingTimeline("CH1", time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC))
+
+	var qvrError *QvrError
+	if !errors.As(err, &qvrError) || qvrError.Code != 0x93010002 {
+		t.Fatalf("RecordingTimeline error = %v, want 0x93010002", err)
+	}
+	if timeline == nil || len(timeline.Recorded) != 4 {
+		t.Fatalf("RecordingTimeline = %+v, want the 4 hours probed before the failure", timeline)
+	}
+	for i, recorded := range timeline.Recorded {
+		if !recorded {
+			t.Errorf("hour %d not recorded", i)
+		}
+	}
+}
+
+func TestExportRecordingStream(t *testing.T) {
+	tests := []struct {
+		name     string
+		streams  string
+		wantPath string
+	}{
+		{name: "single stream", streams: `[{"stream":0}]`, wantPath: "/camera/recordingfile/CH1/0"},
+		{name: "multi stream", streams: `[{"stream":1},{"stream":2}]`, wantPath: "/camera/recordingfile/CH1/1"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var path string
+			transport := roundTripFunc(func(request *http.Request) (*http.Response, error) {
+				if strings.Contains(request.URL.Path, "/camera/recordingfile/") {
+					path = request.URL.Path
+					return cannedTransport(http.StatusOK, "video/mp4", "mp4").RoundTrip(request)
+				}
+				body := `{"success":true,"data":[{"guid":"CH1","stream_state":` + test.streams + `}]}`
+				return cannedTransport(http.StatusOK, "application/json", body).RoundTrip(request)
+			})
+			connection := NewConnection("http://nas", WithTransport(transport))
+
+			var out strings.Builder
+			if err := connection.ExportRecording("CH1", 1000, 2000, &out); err != nil {
+				t.Fatalf("ExportRecording: %v", err)
+			}
+			if !strings.HasSuffix(path, test.wantPath) {
+				t.Errorf("ExportRecording fetched %q, want a path ending in %q", path, test.wantPath)
+			}
+			if out.String() != "mp4" {
+				t.Errorf("ExportRecording wrote %q, want \"mp4\"", out.String())
+			}
+		})
+	}
+}
+
+func TestResolve(t *testing.T) {
+	tests := []struct {
+		name    string
+		url     string
+		want    string
+		wantErr bool
+	}{
+		{name: "host", url: "http://nas:8080", want: "http://nas:8080/qvrpro/camera/list"},
+		{name: "bracketed IPv6 with port", url: "https://[fe80::1]:8443", want: "https://[fe80::1]:8443/qvrpro/camera/list"},
+		{name: "bracketed IPv6 with zone", url: "http://[fe80::1%25eth0]:8080", want: "http://[fe80::1%25eth0]:8080/qvrpro/camera/list"},
+		{name: "path prefix", url: "https://relay.example/device42/", want: "https://relay.example/device42/qvrpro/camera/list"},
+		{name: "unbracketed IPv6", url: "http://fe80::1:8080", wantErr: true},
+		{name: "missing host", url: "http:///qvrpro", wantErr: true},
+		{name: "no scheme", url: "nas:8080", wantErr: true},
+		{name: "non-http scheme", url: "ftp://nas", wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			connection := NewConnection(test.url)
+
+			got, err := connection.resolve(connection.CameraListPath())
+			if test.wantErr {
+				if !errors.Is(err, ErrInvalidURL) {
+					t.Fatalf("resolve(%q) error = %v, want ErrInvalidURL", test.url, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("resolve(%q) error = %v", test.url, err)
+			}
+			if got.String() != test.want {
+				t.Errorf("resolve(%q) = %q, want %q", test.url, got.String(), test.want)
+			}
+		})
+	}
+}
+
+func TestBaseURL(t *testing.T) {
+	tests := []struct {
+		host    string
+		port    int
+		useTLS  bool
+		want    string
+		wantErr bool
+	}{
+		{host: "nas.local", port: 8080, want: "http://nas.local:8080"},
+		{host: "::1", port: 8080, useTLS: true, want: "https://[::1]:8080"},
+		{host: "[fe80::1]", port: 443, useTLS: true, want: "https://[fe80::1]:443"},
+		{host: "", port: 8080, wantErr: true},
+		{host: "nas/qvrpro", port: 8080, wantErr: true},
+		{host: "nas", port: 0, wantErr: true},
+	}
+
+	for _, test := range tests {
+		got, err := BaseURL(test.host, test.port, test.useTLS)
+		if (err != nil) != test.wantErr {
+			t.Errorf("BaseURL(%q, %d, %v) error = %v, want error %v", test.host, test.port, test.useTLS, err, test.wantErr)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("BaseURL(%q, %d, %v) = %q, want %q", test.host, test.port, test.useTLS, got, test.want)
+		}
+		if err == nil {
+			if _, err := NewConnection(got).resolve("/cgi-bin/authLogin.cgi"); err != nil {
+				t.Errorf("resolve of BaseURL(%q, ...) = %q failed: %v", test.host, got, err)
+			}
+		}
+	}
+}
+
+// TestConvertHexToInt checks every code in errorCodes against what the former
+// cgo helper returned: strtol's result narrowed to a C int, which is negative
+// for codes with the high bit set.
+func TestConvertHexToInt(t *testing.T) {
+	negative := 0
+	for code := range errorCodes {
+		hex := fmt.Sprintf("0x%08X", uint32(code))
+
+		parsed, err := strconv.ParseUint(hex[2:], 16, 32)
+		if err != nil {
+			t.Fatalf("cannot parse %s: %v", hex, err)
+		}
+		want := int(int32(uint32(parsed)))
+
+		if got := convertHexToInt(hex); got != want || got != code {
+			t.Errorf("convertHexToInt(%q) = %d, want %d (table key %d)", hex, got, want, code)
+		}
+		if parsed&0x80000000 != 0 {
+			negative++
+			if code >= 0 {
+				t.Errorf("%s has the high bit set but converts to %d", hex, code)
+			}
+		}
+	}
+
+	if negative == 0 {
+		t.Error("errorCodes holds no high-bit codes")
+	}
+	if got := convertHexToInt("not a number"); got != 0 {
+		t.Errorf("convertHexToInt of garbage = %d, want 0", got)
+	}
+}
+
+func TestRedactBody(t *testing.T) {
+	tests := []struct {
+		body string
+		want string
+	}{
+		{`<QDocRoot><authSid>abc123</authSid></QDocRoot>`, `<QDocRoot><authSid>***</authSid></QDocRoot>`},
+		{`{"authPassed":1,"authSid":"abc123","isAdmin":1}`, `{"authPassed":1,"authSid":"***","isAdmin":1}`},
+		{`{"authSid" : "a\"bc"}`, `{"authSid" : "***"}`},
+		{`{"authPassed":0}`, `{"authPassed":0}`},
+	}
+
+	for _, test := range tests {
+		if got := redactBody([]byte(test.body)); got != test.want {
+			t.Errorf("redactBody(%s) = %s, want %s", test.body, got, test.want)
+		}
+	}
+}